@@ -0,0 +1,106 @@
+// Package audit records which job got which role, when and from which caller.
+package audit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record describes a credentials request. It has no field for secrets on purpose,
+// and the access key id is truncated.
+type Record struct {
+	Time        time.Time `json:"time"`
+	RequestId   string    `json:"request_id"`
+	Caller      string    `json:"caller"`
+	Agent       string    `json:"agent,omitempty"`
+	JobId       string    `json:"job_id"`
+	RoleArn     string    `json:"role_arn,omitempty"`
+	Outcome     string    `json:"outcome"`
+	AccessKeyId string    `json:"access_key_id,omitempty"`
+	SessionName string    `json:"session_name,omitempty"`
+}
+
+// Sink receives the audit records.
+type Sink interface {
+	Record(Record)
+}
+
+// NopSink discards the records.
+type NopSink struct{}
+
+func (NopSink) Record(Record) {}
+
+// WriterSink writes every record as a JSON line to a writer.
+func NewWriterSink(writer io.Writer) *WriterSink {
+	return &WriterSink{writer: writer}
+}
+
+// NewFileSink appends the records to a file, or writes them to stdout if path is "-".
+func NewFileSink(path string) (*WriterSink, error) {
+	if path == "-" {
+		return NewWriterSink(os.Stdout), nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWriterSink(file), nil
+}
+
+type WriterSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func (s *WriterSink) Record(record Record) {
+	record.Time = record.Time.UTC()
+	encoded, err := json.Marshal(&record)
+	if err != nil {
+		log.Error("Couldn't encode audit record: ", err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.writer.Write(append(encoded, '\n')); err != nil {
+		log.Error("Couldn't write audit record: ", err)
+	}
+}
+
+// Close closes the underlying writer if it's a closer other than stdout.
+func (s *WriterSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if closer, ok := s.writer.(io.Closer); ok && s.writer != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+// TruncateAccessKeyId keeps only the first and last four characters of an access key id.
+func TruncateAccessKeyId(accessKeyId string) string {
+	if len(accessKeyId) <= 8 {
+		return strings.Repeat("*", len(accessKeyId))
+	}
+	return accessKeyId[:4] + "..." + accessKeyId[len(accessKeyId)-4:]
+}
+
+// NewRequestId returns a random id for a request that didn't bring one.
+func NewRequestId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
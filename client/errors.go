@@ -0,0 +1,122 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ResponseError is an error response of smaug, Code is the error code of its body, empty if the
+// body isn't a smaug error.
+type ResponseError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("smaug answered %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("smaug answered %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// UnknownJobError is returned when smaug has no role for the job, or the job isn't a running task.
+type UnknownJobError struct {
+	JobId string
+	Cause error
+}
+
+func (e *UnknownJobError) Error() string {
+	return fmt.Sprintf("smaug doesn't know job %s: %s", e.JobId, e.Cause)
+}
+
+func (e *UnknownJobError) Unwrap() error {
+	return e.Cause
+}
+
+// AccessDeniedError is returned when the caller isn't allowed to get the credentials of the job,
+// or when STS doesn't allow smaug to assume its role.
+type AccessDeniedError struct {
+	JobId string
+	Cause error
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("Access denied to the credentials of job %s: %s", e.JobId, e.Cause)
+}
+
+func (e *AccessDeniedError) Unwrap() error {
+	return e.Cause
+}
+
+// ThrottledError is returned when smaug, or STS behind it, throttles the requests. RetryAfter is
+// how long smaug asked to wait, zero if it didn't tell.
+type ThrottledError struct {
+	JobId      string
+	RetryAfter time.Duration
+	Cause      error
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("Throttled getting the credentials of job %s: %s", e.JobId, e.Cause)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return e.Cause
+}
+
+// UnavailableError is returned when smaug can't be reached or can't give credentials for now.
+type UnavailableError struct {
+	JobId string
+	Cause error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("smaug unavailable getting the credentials of job %s: %s", e.JobId, e.Cause)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Cause
+}
+
+// errorResponse is the body of the error responses of smaug.
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// classifyResponse turns an error response of smaug into the typed errors above.
+func classifyResponse(jobId string, response *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+
+	cause := &ResponseError{StatusCode: response.StatusCode}
+	var decoded errorResponse
+	if err := json.Unmarshal(body, &decoded); err == nil && decoded.Code != "" {
+		cause.Code = decoded.Code
+		cause.Message = decoded.Message
+	} else {
+		cause.Message = http.StatusText(response.StatusCode)
+	}
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return &UnknownJobError{jobId, cause}
+	case response.StatusCode == http.StatusUnauthorized, response.StatusCode == http.StatusForbidden:
+		return &AccessDeniedError{jobId, cause}
+	case response.StatusCode == http.StatusTooManyRequests:
+		var retryAfter time.Duration
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return &ThrottledError{jobId, retryAfter, cause}
+	case response.StatusCode >= 500:
+		return &UnavailableError{jobId, cause}
+	}
+
+	return cause
+}
@@ -0,0 +1,202 @@
+package client
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/go-errors/errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// ProviderName is the name of the credentials provider, as returned in credentials.Value.
+	ProviderName = "SmaugProvider"
+
+	// DefaultExpiryWindow is how long before they expire the credentials are refreshed.
+	DefaultExpiryWindow = 5 * time.Minute
+	// DefaultRetries is how many times a failed request is retried.
+	DefaultRetries = 3
+	// DefaultRetryDelay is the delay before the first retry, it doubles with every retry.
+	DefaultRetryDelay = 200 * time.Millisecond
+	// DefaultMaxRetryDelay is the longest delay before a retry.
+	DefaultMaxRetryDelay = 10 * time.Second
+)
+
+// credentialsResponse is the body of the /credentials responses.
+type credentialsResponse struct {
+	RoleArn         string `json:"RoleArn"`
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+}
+
+// NewCredentials returns aws credentials retrieved from the smaug at baseUrl for a job.
+func NewCredentials(baseUrl string, jobId string, options ...func(*Provider)) *credentials.Credentials {
+	return credentials.NewCredentials(NewProvider(baseUrl, jobId, options...))
+}
+
+// Provider
+//
+// Provider implements the aws credentials.Provider interface with the credentials smaug gives to a
+// job on /credentials/<job-id>. The credentials are refreshed ExpiryWindow before they expire, and
+// failed requests are retried with exponential backoff unless smaug refused them. If the refresh
+// still fails, the current credentials keep being used until they expire, and the refresh is tried
+// again after MaxRetryDelay, doubling while it keeps failing.
+//
+// Like the other providers, it's meant to be used through a credentials.Credentials, which doesn't
+// call it concurrently.
+func NewProvider(baseUrl string, jobId string, options ...func(*Provider)) *Provider {
+	provider := &Provider{
+		url:           strings.TrimRight(baseUrl, "/") + "/credentials/" + url.PathEscape(jobId),
+		jobId:         jobId,
+		ExpiryWindow:  DefaultExpiryWindow,
+		Retries:       DefaultRetries,
+		RetryDelay:    DefaultRetryDelay,
+		MaxRetryDelay: DefaultMaxRetryDelay,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for _, option := range options {
+		option(provider)
+	}
+
+	return provider
+}
+
+type Provider struct {
+	credentials.Expiry
+
+	url   string
+	jobId string
+
+	// ExpiryWindow is how long before they expire the credentials are refreshed, at most half
+	// of their lifetime.
+	ExpiryWindow time.Duration
+
+	// Retries is how many times a failed request is retried, RetryDelay the delay before the
+	// first retry, and MaxRetryDelay the longest delay, including the one asked by smaug.
+	Retries       int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	Client *http.Client
+
+	// Signer signs the requests if smaug requires signed requests.
+	Signer *Signer
+
+	current    *credentials.Value
+	expiration time.Time
+	failures   int
+}
+
+// Retrieve gets new credentials from smaug.
+func (p *Provider) Retrieve() (credentials.Value, error) {
+	response, err := p.fetchWithRetries()
+	now := p.now()
+	if err != nil {
+		if p.current != nil && now.Before(p.expiration) {
+			// Try again later, backing off while smaug keeps failing so the calls using the current
+			// credentials aren't held by retries, until they expire.
+			backoff := p.MaxRetryDelay << uint(p.failures)
+			if p.failures < 16 {
+				p.failures++
+			}
+			retryAt := now.Add(backoff)
+			if backoff <= 0 || retryAt.After(p.expiration) {
+				retryAt = p.expiration
+			}
+			p.SetExpiration(retryAt, 0)
+			return *p.current, nil
+		}
+		return credentials.Value{ProviderName: ProviderName}, err
+	}
+	p.failures = 0
+
+	expiration, err := time.Parse(time.RFC3339, response.Expiration)
+	if err != nil {
+		return credentials.Value{ProviderName: ProviderName}, errors.Errorf("Invalid expiration of the credentials of job %s: %s", p.jobId, response.Expiration)
+	}
+
+	window := p.ExpiryWindow
+	if lifetime := expiration.Sub(now); window > lifetime/2 {
+		window = lifetime / 2
+	}
+	p.SetExpiration(expiration, window)
+
+	p.current = &credentials.Value{
+		AccessKeyID:     response.AccessKeyId,
+		SecretAccessKey: response.SecretAccessKey,
+		SessionToken:    response.Token,
+		ProviderName:    ProviderName,
+	}
+	p.expiration = expiration
+	return *p.current, nil
+}
+
+func (p *Provider) fetchWithRetries() (*credentialsResponse, error) {
+	delay := p.RetryDelay
+	for attempt := 0; ; attempt++ {
+		response, err := p.fetch()
+		if err == nil || attempt >= p.Retries {
+			return response, err
+		}
+
+		wait := delay
+		switch e := err.(type) {
+		case *ThrottledError:
+			if e.RetryAfter > wait {
+				wait = e.RetryAfter
+			}
+		case *UnavailableError:
+		default:
+			return nil, err
+		}
+		if wait > p.MaxRetryDelay {
+			return nil, err
+		}
+
+		time.Sleep(wait)
+		delay *= 2
+		if delay > p.MaxRetryDelay {
+			delay = p.MaxRetryDelay
+		}
+	}
+}
+
+func (p *Provider) fetch() (*credentialsResponse, error) {
+	request, err := http.NewRequest("GET", p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.Signer != nil {
+		if err := p.Signer.Sign(request); err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := p.Client.Do(request)
+	if err != nil {
+		return nil, &UnavailableError{p.jobId, err}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, classifyResponse(p.jobId, response)
+	}
+
+	var decoded credentialsResponse
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		return nil, &UnavailableError{p.jobId, errors.Errorf("Invalid credentials response: %s", err)}
+	}
+	return &decoded, nil
+}
+
+func (p *Provider) now() time.Time {
+	if p.CurrentTime != nil {
+		return p.CurrentTime()
+	}
+	return time.Now()
+}
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestSignerSignsRequestWithNewNonce(t *testing.T) {
+	signer := NewSigner("key", []byte("secret"))
+	first, _ := http.NewRequest("GET", "http://smaug:8080/credentials/my%2Fjob", nil)
+	second, _ := http.NewRequest("GET", "http://smaug:8080/credentials/my%2Fjob", nil)
+
+	assert.Nil(t, signer.Sign(first))
+	assert.Nil(t, signer.Sign(second))
+
+	assert.Equal(t, "key", first.Header.Get(KeyIdHeader))
+	assert.NotEmpty(t, first.Header.Get(TimestampHeader))
+	assert.NotEqual(t, first.Header.Get(NonceHeader), second.Header.Get(NonceHeader))
+	assert.Equal(t, Signature([]byte("secret"), "GET", "/credentials/my%2Fjob", "key", first.Header.Get(TimestampHeader), first.Header.Get(NonceHeader)), first.Header.Get(SignatureHeader))
+}
+
+func TestSignatureCoversEveryPart(t *testing.T) {
+	signature := Signature([]byte("secret"), "GET", "/credentials/myjob", "key", "1500000000", "nonce")
+
+	assert.NotEqual(t, signature, Signature([]byte("other"), "GET", "/credentials/myjob", "key", "1500000000", "nonce"))
+	assert.NotEqual(t, signature, Signature([]byte("secret"), "POST", "/credentials/myjob", "key", "1500000000", "nonce"))
+	assert.NotEqual(t, signature, Signature([]byte("secret"), "GET", "/credentials/other", "key", "1500000000", "nonce"))
+	assert.NotEqual(t, signature, Signature([]byte("secret"), "GET", "/credentials/myjob", "other", "1500000000", "nonce"))
+	assert.NotEqual(t, signature, Signature([]byte("secret"), "GET", "/credentials/myjob", "key", "1500000001", "nonce"))
+	assert.NotEqual(t, signature, Signature([]byte("secret"), "GET", "/credentials/myjob", "key", "1500000000", "other"))
+}
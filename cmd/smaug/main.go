@@ -2,45 +2,159 @@ package main
 
 import (
 	"flag"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/go-errors/errors"
+	"github.com/schibsted/smaug/audit"
 	"github.com/schibsted/smaug/credentials"
 	http_pkg "github.com/schibsted/smaug/http"
 	"github.com/schibsted/smaug/role"
+	"github.com/schibsted/smaug/server"
 	log "github.com/sirupsen/logrus"
-	"net/http"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 )
 
 var (
 	serverAddr                string
-	DEFAULT_SERVER_ADDRESS    = ":8080"
 	verbose                   bool
 	credentialsRepositoryFile string
+	rolesReloadInterval       time.Duration
+	minimumLifetime           time.Duration
+	refreshBefore             time.Duration
+	idleTimeout               time.Duration
+	sessionName               string
+	tlsCertFile               string
+	tlsKeyFile                string
+	tlsClientCAFile           string
+	tlsAllowedSubjects        string
+	tlsReloadInterval         time.Duration
+	stsRegion                 string
+	stsRegionalEndpoint       bool
+	stsEndpoint               string
+	stsFallbackRegions        string
+	stsCredentials            string
+	stsKeysFile               string
+	stsProfile                string
+	cacheStrategy             string
+	containerTokenKeyFile     string
+	schedulerTokenFile        string
+	signingKeysFile           string
+	auditLog                  string
+	probeSts                  bool
+	shutdownTimeout           time.Duration
+	marathonUrl               string
+	marathonRoleLabel         string
+	mesosMasterUrl            string
+	mesosRoleLabel            string
+	mesosStateTTL             time.Duration
+	bindToAgent               string
+	allowedSources            string
+	deniedSources             string
+	callerRateLimit           float64
+	callerBurst               int
+	jobRateLimit              float64
+	jobBurst                  int
+	roleSources               string
+	defaultRole               string
+	defaultRolePattern        string
 )
 
 func main() {
 	parseFlags()
 	setLogLevel()
-	validateParameters()
 
-	roleRepository, err := role.NewFileRoleRepository(credentialsRepositoryFile)
-	if err != nil {
+	if err := run(); err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
-	stsClient := createStsClient()
-	credentialsRepo := credentials.NewDefaultCredentialsRepository(stsClient)
-	credentialsProvider := credentials.NewDefaultCredentialsProvider(roleRepository, credentialsRepo)
-	credentialsRequestHandler := http_pkg.NewCredentialsProviderHandler(credentialsProvider)
-	http.Handle("/credentials/", credentialsRequestHandler)
-	http.HandleFunc("/health-check/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Ok"))
+}
+
+func run() error {
+	var containerTokenKey, schedulerToken string
+	var err error
+	if containerTokenKeyFile != "" {
+		if containerTokenKey, err = readSecretFile(containerTokenKeyFile); err != nil {
+			return err
+		}
+	}
+	if schedulerTokenFile != "" {
+		if schedulerToken, err = readSecretFile(schedulerTokenFile); err != nil {
+			return err
+		}
+	}
+
+	var signingKeys map[string][]byte
+	if signingKeysFile != "" {
+		if signingKeys, err = readSigningKeysFile(signingKeysFile); err != nil {
+			return err
+		}
+	}
+
+	var auditSink audit.Sink = audit.NopSink{}
+	if auditLog != "" {
+		fileSink, err := audit.NewFileSink(auditLog)
+		if err != nil {
+			return err
+		}
+		defer fileSink.Close()
+		auditSink = fileSink
+	}
+
+	stsConfig := credentials.StsConfig{
+		Region:            stsRegion,
+		RegionalEndpoint:  stsRegionalEndpoint,
+		Endpoint:          stsEndpoint,
+		CredentialsSource: stsCredentials,
+		KeysFile:          stsKeysFile,
+		Profile:           stsProfile,
+	}
+	if stsFallbackRegions != "" {
+		stsConfig.FallbackRegions = strings.Split(stsFallbackRegions, ",")
+	}
+
+	var allowedSubjects []string
+	if tlsAllowedSubjects != "" {
+		allowedSubjects = strings.Split(tlsAllowedSubjects, ";")
+	}
+
+	s := server.NewServer(func(s *server.Server) {
+		s.Address = serverAddr
+		s.RolesFile = credentialsRepositoryFile
+		s.RolesReloadInterval = rolesReloadInterval
+		s.MarathonUrl = marathonUrl
+		s.MarathonRoleLabel = marathonRoleLabel
+		s.MesosMasterUrl = mesosMasterUrl
+		s.MesosRoleLabel = mesosRoleLabel
+		s.MesosStateTTL = mesosStateTTL
+		s.AgentBinding = bindToAgent
+		s.AllowedSources = strings.Split(allowedSources, ",")
+		s.DeniedSources = strings.Split(deniedSources, ",")
+		s.CallerRateLimit = http_pkg.RateLimit{Rate: callerRateLimit, Burst: callerBurst}
+		s.JobRateLimit = http_pkg.RateLimit{Rate: jobRateLimit, Burst: jobBurst}
+		s.RoleSources = strings.Split(roleSources, ",")
+		s.DefaultRole = defaultRole
+		s.DefaultRolePattern = defaultRolePattern
+		s.Sts = stsConfig
+		s.MinimumLifetime = minimumLifetime
+		s.RefreshBefore = refreshBefore
+		s.IdleTimeout = idleTimeout
+		s.SessionName = sessionName
+		s.CacheStrategy = cacheStrategy
+		s.ContainerTokenKey = []byte(containerTokenKey)
+		s.SchedulerToken = schedulerToken
+		s.SigningKeys = signingKeys
+		s.TLSCertFile = tlsCertFile
+		s.TLSKeyFile = tlsKeyFile
+		s.ClientCAFile = tlsClientCAFile
+		s.AllowedClientSubjects = allowedSubjects
+		s.TLSReloadInterval = tlsReloadInterval
+		s.AuditSink = auditSink
+		s.ProbeSts = probeSts
+		s.ShutdownTimeout = shutdownTimeout
 	})
 
-	log.Info("Listening on ", serverAddr)
-	log.Panic(http.ListenAndServe(serverAddr, nil))
+	return s.Run()
 }
 
 func setLogLevel() {
@@ -51,26 +165,82 @@ func setLogLevel() {
 	}
 }
 
-func validateParameters() {
-	if credentialsRepositoryFile == "" {
-		log.Error("credentials-repository-file is required")
-		os.Exit(1)
+func readSecretFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
 	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// readSigningKeysFile reads "<key-id>=<key>" lines, ignoring empty lines and comments.
+func readSigningKeysFile(path string) (map[string][]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.Errorf("Invalid signing key at line %d of %s", i+1, path)
+		}
+		keys[strings.TrimSpace(parts[0])] = []byte(strings.TrimSpace(parts[1]))
+	}
+	if len(keys) == 0 {
+		return nil, errors.Errorf("No signing key found in %s", path)
+	}
+	return keys, nil
 }
 
 func parseFlags() {
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbosity")
-	flag.StringVar(&serverAddr, "server-address", DEFAULT_SERVER_ADDRESS, "Server address")
+	flag.StringVar(&serverAddr, "server-address", server.DefaultAddress, "Server address")
 	flag.StringVar(&credentialsRepositoryFile, "credentials-repository-file", "", "Credentials Repository False")
+	flag.DurationVar(&minimumLifetime, "credentials-minimum-lifetime", credentials.DefaultMinimumLifetime, "Minimum time returned credentials must still be valid for")
+	flag.DurationVar(&refreshBefore, "credentials-refresh-before", credentials.DefaultRefreshBefore, "How long before expiring cached credentials are renewed in the background, at most half their lifetime")
+	flag.DurationVar(&idleTimeout, "credentials-idle-timeout", credentials.DefaultIdleTimeout, "Stop renewing credentials of roles not requested for this long")
+	flag.StringVar(&sessionName, "session-name", credentials.DefaultSessionName, "Template of the role session names, ${job} and ${app} are replaced with the job and its app")
+	flag.StringVar(&cacheStrategy, "credentials-cache", credentials.CachePerRole, "Cache credentials per role, shared by its jobs, or per job, with the job in the role session name at the cost of an STS call per job")
+	flag.StringVar(&stsRegion, "sts-region", credentials.DefaultStsRegion, "Region of STS")
+	flag.BoolVar(&stsRegionalEndpoint, "sts-regional-endpoint", false, "Call the regional STS endpoint instead of the global one")
+	flag.StringVar(&stsEndpoint, "sts-endpoint", "", "Url of STS, overriding the one of the region")
+	flag.StringVar(&stsFallbackRegions, "sts-fallback-regions", "", "Regions whose STS endpoints are called in order when the previous ones can't be reached")
+	flag.StringVar(&stsCredentials, "sts-credentials", credentials.CredentialsFromDefaultChain, "Source of the credentials roles are assumed with: default, keys-file, profile or instance-role")
+	flag.StringVar(&stsKeysFile, "sts-keys-file", "", "File with the keys roles are assumed with, in the format of the shared credentials file")
+	flag.StringVar(&stsProfile, "sts-profile", "", "Profile of the shared config roles are assumed with")
+	flag.StringVar(&containerTokenKeyFile, "container-token-key-file", "", "File with the key container authorization tokens are derived from")
+	flag.StringVar(&schedulerTokenFile, "scheduler-token-file", "", "File with the token the scheduler uses to get container authorization tokens")
+	flag.StringVar(&signingKeysFile, "signing-keys-file", "", "File with the keys, as <key-id>=<key> lines, /credentials requests can be signed with")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "Certificate to serve HTTPS with")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", "", "Key of the TLS certificate")
+	flag.StringVar(&tlsClientCAFile, "tls-client-ca-file", "", "CA bundle the client certificates required on /credentials are verified with")
+	flag.StringVar(&tlsAllowedSubjects, "tls-allowed-subjects", "", "Client certificate subjects allowed on /credentials, by common name or distinguished name, separated by ;")
+	flag.DurationVar(&tlsReloadInterval, "tls-reload-interval", server.DefaultTLSReloadInterval, "How often to check the TLS certificate, key and client CA files for changes")
+	flag.StringVar(&auditLog, "audit-log", "", "File to write the audit log of credentials requests to, - for stdout")
+	flag.BoolVar(&probeSts, "readiness-probe-sts", false, "Call STS GetCallerIdentity on readiness checks when no STS call succeeded recently")
+	flag.DurationVar(&rolesReloadInterval, "roles-reload-interval", server.DefaultRolesReloadInterval, "How often to check the credentials repository file for changes, 0 to only reload on SIGHUP")
+	flag.StringVar(&marathonUrl, "marathon-url", "", "Marathon url to read the roles of tasks from the labels of their apps")
+	flag.StringVar(&marathonRoleLabel, "marathon-role-label", role.DefaultMarathonRoleLabel, "Marathon app label holding the role of its tasks")
+	flag.StringVar(&roleSources, "role-sources", server.RolesFileSource+","+server.MarathonSource, "Order in which the configured role sources are asked for the role of a job, among file, marathon and mesos-labels")
+	flag.StringVar(&defaultRole, "default-role", "", "Role given to the jobs matching default-role-pattern that no role source knows")
+	flag.StringVar(&defaultRolePattern, "default-role-pattern", "", "Glob of the jobs that get the default role")
+	flag.StringVar(&mesosMasterUrl, "mesos-master-url", "", "Mesos master url to only give roles to jobs that are running tasks. Its whole state, several megabytes on large clusters, is downloaded every mesos-state-ttl by every replica")
+	flag.DurationVar(&mesosStateTTL, "mesos-state-ttl", role.DefaultMesosTTL, "How often the state of the Mesos master is downloaded, and how long a finished task can still get credentials")
+	flag.StringVar(&mesosRoleLabel, "mesos-role-label", role.DefaultTaskRoleLabel, "Mesos task label holding the role of the task, read by the mesos-labels role source")
+	flag.StringVar(&allowedSources, "allowed-sources", "", "Networks, in CIDR notation and separated by commas, the credentials endpoints accept requests from")
+	flag.StringVar(&deniedSources, "denied-sources", "", "Networks, in CIDR notation and separated by commas, the credentials endpoints refuse requests from")
+	flag.Float64Var(&callerRateLimit, "caller-rate-limit", 0, "Requests per second to the credentials endpoints allowed per caller address, unlimited if zero")
+	flag.IntVar(&callerBurst, "caller-burst", 10, "Requests a caller can make in a burst, above its rate limit")
+	flag.Float64Var(&jobRateLimit, "job-rate-limit", 0, "Requests per second to the credentials endpoints allowed per job, unlimited if zero")
+	flag.IntVar(&jobBurst, "job-burst", 5, "Requests for a job that can be made in a burst, above its rate limit")
+	flag.StringVar(&bindToAgent, "bind-to-agent", "", "Only give the credentials of jobs to the Mesos agents running their tasks, identified by \"address\" or \"certificate\"")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", server.DefaultShutdownTimeout, "How long to wait for in-flight requests on SIGTERM or SIGINT")
 
 	flag.Parse()
 }
-
-func createStsClient() *sts.STS {
-	config := &aws.Config{
-		Region: aws.String("eu-west-1"),
-	}
-	sess := session.Must(session.NewSession(config))
-	stsClient := sts.New(sess)
-	return stsClient
-}
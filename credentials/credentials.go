@@ -6,4 +6,8 @@ type SmaugCredentials struct {
 	SecretAccessKey string `json:"SecretAccessKey"`
 	SessionToken    string `json:"Token"`
 	Expiration      string `json:"Expiration"`
+	// LastUpdated is when the credentials were issued, it's not part of the /credentials response.
+	LastUpdated string `json:"-"`
+	// SessionName is the role session name the credentials were issued with, shown in CloudTrail.
+	SessionName string `json:"-"`
 }
@@ -0,0 +1,143 @@
+package credentials
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// CredentialsNotFoundError is returned when there are no credentials for a job.
+type CredentialsNotFoundError struct {
+	JobId string
+}
+
+func (e *CredentialsNotFoundError) Error() string {
+	return fmt.Sprintf("Couldn't find credentials for job: %s", e.JobId)
+}
+
+// JobRoleError is returned when the role of a job can't be found, Cause tells why.
+type JobRoleError struct {
+	JobId string
+	Cause error
+}
+
+func (e *JobRoleError) Error() string {
+	return fmt.Sprintf("Could not get role for job: %s", e.JobId)
+}
+
+func (e *JobRoleError) Unwrap() error {
+	return e.Cause
+}
+
+// RoleCredentialsError is returned when the credentials of a role can't be retrieved, Cause tells why.
+type RoleCredentialsError struct {
+	RoleArn string
+	Cause   error
+}
+
+func (e *RoleCredentialsError) Error() string {
+	return fmt.Sprintf("Could not get credentials for role: %s", e.RoleArn)
+}
+
+func (e *RoleCredentialsError) Unwrap() error {
+	return e.Cause
+}
+
+// AssumeRoleDeniedError is returned when STS doesn't allow assuming a role.
+type AssumeRoleDeniedError struct {
+	RoleArn string
+	Cause   error
+}
+
+func (e *AssumeRoleDeniedError) Error() string {
+	return fmt.Sprintf("Access denied assuming role %s: %s", e.RoleArn, e.Cause)
+}
+
+func (e *AssumeRoleDeniedError) Unwrap() error {
+	return e.Cause
+}
+
+// ThrottledError is returned when STS throttles the requests to assume a role.
+type ThrottledError struct {
+	RoleArn string
+	Cause   error
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("Throttled assuming role %s: %s", e.RoleArn, e.Cause)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return e.Cause
+}
+
+// UpstreamUnavailableError is returned when STS can't be reached or fails to answer.
+// StatusCode is the status STS answered with, or 0 if it couldn't be reached.
+type UpstreamUnavailableError struct {
+	RoleArn    string
+	StatusCode int
+	Cause      error
+}
+
+func (e *UpstreamUnavailableError) Error() string {
+	return fmt.Sprintf("STS unavailable assuming role %s: %s", e.RoleArn, e.Cause)
+}
+
+func (e *UpstreamUnavailableError) Unwrap() error {
+	return e.Cause
+}
+
+// ChainStepError is returned when a role assumed via a hub role can't be assumed. Step is the
+// role of the chain that failed, 1 for the hub role and 2 for the role itself.
+type ChainStepError struct {
+	Step    int
+	RoleArn string
+	Cause   error
+}
+
+func (e *ChainStepError) Error() string {
+	return fmt.Sprintf("Role chain failed at step %d, assuming role %s: %s", e.Step, e.RoleArn, e.Cause)
+}
+
+func (e *ChainStepError) Unwrap() error {
+	return e.Cause
+}
+
+// classifyStsError turns the errors of an AssumeRole call into the typed errors above,
+// errors it doesn't know about are returned as they are.
+func classifyStsError(roleArn string, err error) error {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+
+	switch awsErr.Code() {
+	case "AccessDenied", sts.ErrCodeRegionDisabledException:
+		return &AssumeRoleDeniedError{roleArn, err}
+	case sts.ErrCodeExpiredTokenException:
+		// The credentials of smaug itself expired, no role can be assumed until they're renewed.
+		var statusCode int
+		if failure, ok := err.(awserr.RequestFailure); ok {
+			statusCode = failure.StatusCode()
+		}
+		return &UpstreamUnavailableError{roleArn, statusCode, err}
+	case "Throttling", "ThrottlingException", "RequestLimitExceeded":
+		return &ThrottledError{roleArn, err}
+	case "RequestError", request.ErrCodeResponseTimeout, request.ErrCodeSerialization:
+		return &UpstreamUnavailableError{roleArn, 0, err}
+	}
+
+	if failure, ok := err.(awserr.RequestFailure); ok {
+		switch {
+		case failure.StatusCode() == 403:
+			return &AssumeRoleDeniedError{roleArn, err}
+		case failure.StatusCode() == 429:
+			return &ThrottledError{roleArn, err}
+		case failure.StatusCode() >= 500:
+			return &UpstreamUnavailableError{roleArn, failure.StatusCode(), err}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,46 @@
+package credentials
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/go-errors/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestClassifyStsErrorReturnsTypedErrors(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	accessDenied := awserr.NewRequestFailure(awserr.New("AccessDenied", "Not authorized", nil), 403, "id")
+	assert.Equal(t, &AssumeRoleDeniedError{roleArn, accessDenied}, classifyStsError(roleArn, accessDenied))
+
+	throttled := awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "id")
+	assert.Equal(t, &ThrottledError{roleArn, throttled}, classifyStsError(roleArn, throttled))
+
+	serverError := awserr.NewRequestFailure(awserr.New("InternalFailure", "Internal failure", nil), 503, "id")
+	assert.Equal(t, &UpstreamUnavailableError{roleArn, 503, serverError}, classifyStsError(roleArn, serverError))
+
+	expiredToken := awserr.NewRequestFailure(awserr.New("ExpiredTokenException", "The security token included in the request is expired", nil), 400, "id")
+	assert.Equal(t, &UpstreamUnavailableError{roleArn, 400, expiredToken}, classifyStsError(roleArn, expiredToken))
+
+	unreachable := awserr.New("RequestError", "send request failed", nil)
+	assert.Equal(t, &UpstreamUnavailableError{roleArn, 0, unreachable}, classifyStsError(roleArn, unreachable))
+
+	other := errors.Errorf("Unexpected")
+	assert.Equal(t, other, classifyStsError(roleArn, other))
+}
+
+func TestDefaultCredentialsProviderKeepsCauseOfErrors(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+	jobName := "mytestjob"
+	cause := errors.Errorf("No credentials")
+
+	credentialsRepository := &mockCredentialsRepository{err: cause}
+	roleRepository := mockRoleRepository{jobName: roleArn}
+	credentialsProvider := NewDefaultCredentialsProvider(roleRepository, credentialsRepository)
+
+	_, err := credentialsProvider.GetCredentialsForJob(jobName)
+
+	if assert.IsType(t, &RoleCredentialsError{}, err) {
+		assert.Equal(t, cause, err.(*RoleCredentialsError).Unwrap())
+	}
+}
@@ -0,0 +1,43 @@
+package credentials
+
+import (
+	"sync"
+)
+
+// flightGroup merges concurrent calls for the same key into one, all callers get the same result.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done   sync.WaitGroup
+	result *cachedCredentials
+	err    error
+}
+
+func (g *flightGroup) Do(key string, fn func() (*cachedCredentials, error)) (*cachedCredentials, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		call.done.Wait()
+		return call.result, call.err
+	}
+
+	call := &flight{}
+	call.done.Add(1)
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	call.result, call.err = fn()
+	call.done.Done()
+
+	g.mutex.Lock()
+	delete(g.calls, key)
+	g.mutex.Unlock()
+
+	return call.result, call.err
+}
@@ -0,0 +1,89 @@
+package credentials
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"time"
+)
+
+var (
+	assumeRoleCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smaug_sts_assume_role_total",
+		Help: "AssumeRole calls by result.",
+	}, []string{"result"})
+	assumeRoleDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "smaug_sts_assume_role_duration_seconds",
+		Help: "Latency of AssumeRole calls.",
+	})
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smaug_credentials_cache_lookups_total",
+		Help: "Credentials cache lookups by result, hit or miss.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(Collectors()...)
+}
+
+// Collectors returns the metrics of the STS calls and cache lookups of all the repositories.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{assumeRoleCalls, assumeRoleDuration, cacheLookups}
+}
+
+// CacheStats describes the credentials cached by a DefaultCredentialsRepository.
+type CacheStats struct {
+	CachedRoles int
+	// SoonestExpiration is when the first of the cached credentials expires, zero if there are none.
+	SoonestExpiration time.Time
+}
+
+func (r *DefaultCredentialsRepository) Stats() CacheStats {
+	stats := CacheStats{}
+	for _, cached := range r.cached() {
+		stats.CachedRoles++
+		if stats.SoonestExpiration.IsZero() || cached.expiration.Before(stats.SoonestExpiration) {
+			stats.SoonestExpiration = cached.expiration
+		}
+	}
+	return stats
+}
+
+// Collectors returns the metrics of the credentials cached by the repository.
+func (r *DefaultCredentialsRepository) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "smaug_credentials_cached_roles",
+			Help: "Number of roles with cached credentials.",
+		}, func() float64 {
+			return float64(r.Stats().CachedRoles)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "smaug_credentials_soonest_expiry_seconds",
+			Help: "Seconds until the first of the cached credentials expires.",
+		}, func() float64 {
+			soonest := r.Stats().SoonestExpiration
+			if soonest.IsZero() {
+				return math.Inf(1)
+			}
+			return soonest.Sub(time.Now()).Seconds()
+		}),
+	}
+}
+
+// errorClass returns the label of an AssumeRole error in the metrics.
+func errorClass(err error) string {
+	switch e := err.(type) {
+	case nil:
+		return "Success"
+	case *AssumeRoleDeniedError:
+		return "AccessDenied"
+	case *ThrottledError:
+		return "Throttled"
+	case *UpstreamUnavailableError:
+		if e.StatusCode != 0 {
+			return "UpstreamError"
+		}
+		return "UpstreamUnavailable"
+	}
+	return "Error"
+}
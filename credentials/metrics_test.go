@@ -0,0 +1,54 @@
+package credentials
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/schibsted/smaug/role"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDefaultCredentialsRepositoryCountsCacheLookupsAndAssumeRoleCalls(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/metrics"
+	hits, misses := counterValue(cacheLookups, "hit"), counterValue(cacheLookups, "miss")
+	successes, throttled := counterValue(assumeRoleCalls, "Success"), counterValue(assumeRoleCalls, "Throttled")
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(60*time.Minute)))
+	repo := NewDefaultCredentialsRepository(stub)
+
+	repo.FindCredentialsByRole(role.NewRole(roleArn))
+	repo.FindCredentialsByRole(role.NewRole(roleArn))
+
+	stub.SetError(awserr.New("Throttling", "Rate exceeded", nil))
+	repo.FindCredentialsByRole(role.NewRole("arn:aws:iam::111111111:myrole/throttled"))
+
+	assert.Equal(t, hits+1, counterValue(cacheLookups, "hit"))
+	assert.Equal(t, misses+2, counterValue(cacheLookups, "miss"))
+	assert.Equal(t, successes+1, counterValue(assumeRoleCalls, "Success"))
+	assert.Equal(t, throttled+1, counterValue(assumeRoleCalls, "Throttled"))
+}
+
+func TestDefaultCredentialsRepositoryStats(t *testing.T) {
+	soonest := time.Now().Add(30 * time.Minute).UTC().Truncate(time.Second)
+
+	stub := &MockSTSClient{}
+	repo := NewDefaultCredentialsRepository(stub)
+
+	assert.Equal(t, CacheStats{}, repo.Stats())
+
+	stub.SetCredentials(getStsCredentials("Key", soonest.Add(30*time.Minute)))
+	repo.FindCredentialsByRole(role.NewRole("arn:aws:iam::111111111:myrole/role"))
+	stub.SetCredentials(getStsCredentials("Key", soonest))
+	repo.FindCredentialsByRole(role.NewRole("arn:aws:iam::111111111:myrole/other"))
+
+	assert.Equal(t, CacheStats{2, soonest}, repo.Stats())
+}
+
+func counterValue(counter *prometheus.CounterVec, labelValues ...string) float64 {
+	var metric dto.Metric
+	counter.WithLabelValues(labelValues...).Write(&metric)
+	return metric.GetCounter().GetValue()
+}
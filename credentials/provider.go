@@ -1,8 +1,19 @@
 package credentials
 
 import (
-	"github.com/go-errors/errors"
 	"github.com/schibsted/smaug/role"
+	"strings"
+)
+
+const (
+	// CachePerJob gives every job credentials of its own, with the job in their role session name.
+	CachePerJob = "job"
+	// CachePerRole shares the credentials of a role between all its jobs.
+	CachePerRole = "role"
+	// DefaultSessionName is the template of the role session names of the jobs.
+	DefaultSessionName = "${job}"
+	// SharedSessionName is the role session name of the credentials shared by the jobs of a role.
+	SharedSessionName = "smaug"
 )
 
 type CredentialsProvider interface {
@@ -29,34 +40,71 @@ func (r *InMemoryCredentialsProvider) GetCredentialsForJob(jobId string) (*Smaug
 		return creds, nil
 	}
 
-	return nil, errors.Errorf("Couldn't find credentials for job: %s", jobId)
+	return nil, &CredentialsNotFoundError{jobId}
 }
 
 // Default Credentials Provider
-func NewDefaultCredentialsProvider(roleRepository role.RoleRepository, credentialsRepository CredentialsRepository) *DefaultCredentialsProvider {
-	return &DefaultCredentialsProvider{
-		roleRepository,
-		credentialsRepository,
+func NewDefaultCredentialsProvider(roleRepository role.RoleRepository, credentialsRepository CredentialsRepository, options ...func(*DefaultCredentialsProvider)) *DefaultCredentialsProvider {
+	provider := &DefaultCredentialsProvider{
+		roleRepository:        roleRepository,
+		credentialsRepository: credentialsRepository,
+		SessionName:           DefaultSessionName,
+		CacheStrategy:         CachePerRole,
+	}
+
+	for _, option := range options {
+		option(provider)
 	}
+
+	return provider
 }
 
 type DefaultCredentialsProvider struct {
 	roleRepository        role.RoleRepository
 	credentialsRepository CredentialsRepository
+
+	// SessionName is the template of the role session names for the roles that don't have their own.
+	SessionName string
+
+	// CacheStrategy tells whether jobs get credentials of their own, named after them, or share
+	// the credentials of their role.
+	CacheStrategy string
 }
 
 func (provider *DefaultCredentialsProvider) GetCredentialsForJob(jobId string) (*SmaugCredentials, error) {
-	roleArn, err := provider.roleRepository.FindRoleByJobId(jobId)
+	jobRole, err := provider.roleRepository.FindRoleByJobId(jobId)
 
 	if err != nil {
-		return nil, errors.Errorf("Could not get role for job: %s", jobId)
+		return nil, &JobRoleError{jobId, err}
 	}
 
-	creds, err := provider.credentialsRepository.FindCredentialsByRoleArn(roleArn)
+	creds, err := provider.credentialsRepository.FindCredentialsByRole(provider.assumedRole(jobRole, jobId))
 
 	if err != nil {
-		return nil, errors.Errorf("Could not get credentials for role: %s", roleArn)
+		return nil, &RoleCredentialsError{jobRole.Arn, err}
 	}
 
 	return creds, nil
 }
+
+// assumedRole returns how the role is assumed for the job. Credentials are cached by role session
+// name and policy among others, so with CachePerJob they're named after the job, and with
+// CachePerRole they get a name that doesn't depend on the job. A policy is always expanded for the
+// job, so with CachePerRole the jobs of a role only share credentials if their policies are the same.
+func (provider *DefaultCredentialsProvider) assumedRole(jobRole *role.Role, jobId string) *role.Role {
+	assumed := *jobRole
+	if provider.CacheStrategy == CachePerRole {
+		sessionName := assumed.SessionName
+		if sessionName == "" || strings.Contains(sessionName, "${") {
+			sessionName = SharedSessionName
+		}
+		expanded := assumed.ForJob(jobId)
+		expanded.SessionName = role.SessionName(sessionName)
+		return expanded
+	}
+
+	if assumed.SessionName == "" {
+		assumed.SessionName = provider.SessionName
+	}
+	return assumed.ForJob(jobId)
+}
@@ -2,10 +2,12 @@ package credentials
 
 import (
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/go-errors/errors"
 	"github.com/schibsted/smaug/role"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestInMemoryProviderFindCredentialsByJobName(t *testing.T) {
@@ -49,7 +51,7 @@ func TestComposableProviderFindCredentialsByJobName(t *testing.T) {
 	roleRepository.AddRole(jobName, roleArn)
 
 	credentialsRepository := &mockCredentialsRepository{
-		GetCredentials("arn:aws:iam::111111111:myrole/role", expectedAccessKey, expectedSecretKey, expectedToken),
+		creds: GetCredentials("arn:aws:iam::111111111:myrole/role", expectedAccessKey, expectedSecretKey, expectedToken),
 	}
 	credentialsProvider := NewDefaultCredentialsProvider(roleRepository, credentialsRepository)
 
@@ -71,6 +73,7 @@ func TestComposableProviderFindCredentialsByJobNameReturnsErrorIfJobHasNoRole(t
 
 	if assert.Error(t, err, "An error was expected") {
 		assert.Equal(t, err.Error(), fmt.Sprintf("Could not get role for job: %s", jobName))
+		assert.IsType(t, &role.UnknownJobError{}, err.(*JobRoleError).Unwrap())
 	}
 
 	assert.Nil(t, credentialsValues)
@@ -94,14 +97,98 @@ func TestComposableProviderFindCredentialsByJobNameReturnsErrorIfRoleHasNoCreden
 	assert.Nil(t, credentialsValues)
 }
 
+func TestDefaultProviderNamesSessionsAfterTheJob(t *testing.T) {
+	roleRepository := role.NewInMemoryRoleRepository()
+	roleRepository.AddRole("team_app.1234", "arn:aws:iam::111111111:myrole/role")
+	roleRepository.AddRole("team_app.5678", "arn:aws:iam::111111111:myrole/role")
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(60*time.Minute)))
+	credentialsProvider := NewDefaultCredentialsProvider(roleRepository, NewDefaultCredentialsRepository(stub), func(p *DefaultCredentialsProvider) {
+		p.CacheStrategy = CachePerJob
+	})
+
+	creds, err := credentialsProvider.GetCredentialsForJob("team_app.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, "team_app.1234", creds.SessionName)
+	assert.Equal(t, "team_app.1234", aws.StringValue(stub.LastInput().RoleSessionName))
+
+	creds, err = credentialsProvider.GetCredentialsForJob("team_app.5678")
+	assert.Nil(t, err)
+	assert.Equal(t, "team_app.5678", creds.SessionName)
+	assert.Equal(t, 2, stub.Calls())
+}
+
+func TestDefaultProviderSharesCredentialsOfRolesByDefault(t *testing.T) {
+	roleRepository := role.NewInMemoryRoleRepository()
+	roleRepository.AddRole("team_app.1234", "arn:aws:iam::111111111:myrole/role")
+	roleRepository.AddRole("team_app.5678", "arn:aws:iam::111111111:myrole/role")
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(60*time.Minute)))
+	credentialsProvider := NewDefaultCredentialsProvider(roleRepository, NewDefaultCredentialsRepository(stub))
+
+	credentialsProvider.GetCredentialsForJob("team_app.1234")
+	creds, err := credentialsProvider.GetCredentialsForJob("team_app.5678")
+	assert.Nil(t, err)
+	assert.Equal(t, SharedSessionName, creds.SessionName)
+	assert.Equal(t, 1, stub.Calls())
+}
+
+func TestDefaultProviderExpandsPolicyTemplateWithCachePerRole(t *testing.T) {
+	policy := `{"Statement":[{"Effect":"Allow","Action":"s3:*","Resource":"arn:aws:s3:::bucket/${job.app}/*"}]}`
+	roleRepository := role.NewInMemoryRoleRepository()
+	for _, jobId := range []string{"team_app.1234", "team_app.5678", "team_web.1234"} {
+		roleRepository.SetRole(jobId, &role.Role{Arn: "arn:aws:iam::111111111:myrole/role", Policy: policy})
+	}
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(60*time.Minute)))
+	credentialsProvider := NewDefaultCredentialsProvider(roleRepository, NewDefaultCredentialsRepository(stub), func(p *DefaultCredentialsProvider) {
+		p.CacheStrategy = CachePerRole
+	})
+
+	_, err := credentialsProvider.GetCredentialsForJob("team_app.1234")
+	assert.Nil(t, err)
+	assert.Contains(t, aws.StringValue(stub.LastInput().Policy), "bucket/team_app/*")
+	assert.Equal(t, SharedSessionName, aws.StringValue(stub.LastInput().RoleSessionName))
+
+	_, err = credentialsProvider.GetCredentialsForJob("team_app.5678")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stub.Calls())
+
+	_, err = credentialsProvider.GetCredentialsForJob("team_web.1234")
+	assert.Nil(t, err)
+	assert.Contains(t, aws.StringValue(stub.LastInput().Policy), "bucket/team_web/*")
+	assert.Equal(t, 2, stub.Calls())
+}
+
+func TestDefaultProviderExpandsSessionNameTemplate(t *testing.T) {
+	roleRepository := role.NewInMemoryRoleRepository()
+	roleRepository.AddRole("team_app.1234", "arn:aws:iam::111111111:myrole/role")
+	roleRepository.SetRole("team_web.1234", &role.Role{Arn: "arn:aws:iam::111111111:myrole/role", SessionName: "web-${job}"})
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(60*time.Minute)))
+	credentialsProvider := NewDefaultCredentialsProvider(roleRepository, NewDefaultCredentialsRepository(stub), func(p *DefaultCredentialsProvider) {
+		p.SessionName = "smaug@${app}"
+		p.CacheStrategy = CachePerJob
+	})
+
+	creds, _ := credentialsProvider.GetCredentialsForJob("team_app.1234")
+	assert.Equal(t, "smaug@team_app", creds.SessionName)
+
+	creds, _ = credentialsProvider.GetCredentialsForJob("team_web.1234")
+	assert.Equal(t, "web-team_web.1234", creds.SessionName)
+}
+
 func GetCredentials(roleArn string, accessKey string, secretKey string, token string) *SmaugCredentials {
 	creds := &SmaugCredentials{
 		// Just reflect the role arn to the provider.
-		roleArn,
-		accessKey,
-		secretKey,
-		token,
-		"",
+		RoleArn:         roleArn,
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		SessionToken:    token,
 	}
 
 	return creds
@@ -109,11 +196,24 @@ func GetCredentials(roleArn string, accessKey string, secretKey string, token st
 
 type mockCredentialsRepository struct {
 	creds *SmaugCredentials
+	err   error
 }
 
-func (r *mockCredentialsRepository) FindCredentialsByRoleArn(roleArn string) (*SmaugCredentials, error) {
-	if r.creds == nil || r.creds.RoleArn != roleArn {
+func (r *mockCredentialsRepository) FindCredentialsByRole(role *role.Role) (*SmaugCredentials, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.creds == nil || r.creds.RoleArn != role.Arn {
 		return nil, errors.Errorf("No credentials")
 	}
 	return r.creds, nil
 }
+
+type mockRoleRepository map[string]string
+
+func (r mockRoleRepository) FindRoleByJobId(jobId string) (*role.Role, error) {
+	if roleArn, ok := r[jobId]; ok {
+		return role.NewRole(roleArn), nil
+	}
+	return nil, &role.UnknownJobError{JobId: jobId}
+}
@@ -0,0 +1,195 @@
+package credentials
+
+import (
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRefreshInterval is how often the refresher checks the cached credentials.
+	DefaultRefreshInterval = 30 * time.Second
+	// DefaultRefreshBefore is how long before expiring cached credentials are renewed.
+	DefaultRefreshBefore = 15 * time.Minute
+	// DefaultRefreshJitter is the maximum random time added to RefreshBefore for every role.
+	DefaultRefreshJitter = 5 * time.Minute
+	// DefaultIdleTimeout is how long a role can go without requests and still be refreshed.
+	DefaultIdleTimeout = 1 * time.Hour
+	// DefaultRefreshRetryDelay is how long after a failed refresh a role is refreshed again, it
+	// doubles with every failure.
+	DefaultRefreshRetryDelay = 30 * time.Second
+	// DefaultMaxRefreshRetryDelay is the longest delay before refreshing a role again.
+	DefaultMaxRefreshRetryDelay = 5 * time.Minute
+)
+
+// Refresher renews the credentials cached in a DefaultCredentialsRepository before they expire,
+// so requests don't have to wait for STS.
+func NewRefresher(repository *DefaultCredentialsRepository, options ...func(*Refresher)) *Refresher {
+	refresher := &Refresher{
+		repository:    repository,
+		Interval:      DefaultRefreshInterval,
+		RefreshBefore: DefaultRefreshBefore,
+		Jitter:        DefaultRefreshJitter,
+		IdleTimeout:   DefaultIdleTimeout,
+		RetryDelay:    DefaultRefreshRetryDelay,
+		MaxRetryDelay: DefaultMaxRefreshRetryDelay,
+		refreshAt:     make(map[string]scheduledRefresh),
+	}
+
+	for _, option := range options {
+		option(refresher)
+	}
+
+	return refresher
+}
+
+type Refresher struct {
+	repository *DefaultCredentialsRepository
+
+	// Interval between checks of the cached credentials.
+	Interval time.Duration
+
+	// RefreshBefore is how long before expiring credentials are renewed. With the jitter it's
+	// capped at half the lifetime of the credentials, so short lived roles aren't renewed on every
+	// check.
+	RefreshBefore time.Duration
+
+	// Jitter is the maximum random time added to RefreshBefore, so roles cached together
+	// don't refresh together.
+	Jitter time.Duration
+
+	// IdleTimeout is how long a role can go without requests before it stops being refreshed.
+	// Its credentials are dropped from the cache once they expire.
+	IdleTimeout time.Duration
+
+	// RetryDelay is how long after a failed refresh the role is refreshed again, doubling with
+	// every failure up to MaxRetryDelay, so a failing role isn't sent to STS on every check.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	mutex     sync.Mutex
+	refreshAt map[string]scheduledRefresh
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+type scheduledRefresh struct {
+	expiration time.Time
+	at         time.Time
+	failures   uint
+}
+
+// Start refreshes the cached credentials in the background until Stop is called.
+func (r *Refresher) Start() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go r.run(r.stop, r.done)
+}
+
+// Stop stops refreshing and waits for an ongoing refresh to finish.
+func (r *Refresher) Stop() {
+	r.mutex.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (r *Refresher) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.refreshExpiring()
+		}
+	}
+}
+
+func (r *Refresher) refreshExpiring() {
+	now := time.Now()
+	cached := r.repository.cached()
+	scheduled := make(map[string]scheduledRefresh, len(cached))
+
+	for _, entry := range cached {
+		idleSince := now.Add(-r.IdleTimeout)
+		if entry.lastUsed.Before(idleSince) {
+			if !entry.expiration.After(now) {
+				log.Debugf("Dropping expired credentials for idle role %s", entry.role)
+				r.repository.evict(entry.key, idleSince)
+			}
+			continue
+		}
+
+		refresh := r.schedule(entry)
+		scheduled[entry.key] = refresh
+		if now.Before(refresh.at) {
+			continue
+		}
+
+		log.Debugf("Refreshing credentials for role %s expiring at %s", entry.role, entry.credentials.Expiration)
+		if _, err := r.repository.refresh(entry.role); err != nil {
+			log.Errorf("Could not refresh credentials for role %s, keeping the ones expiring at %s: %s", entry.role, entry.credentials.Expiration, err)
+			scheduled[entry.key] = r.retry(refresh, now)
+		}
+	}
+
+	r.mutex.Lock()
+	r.refreshAt = scheduled
+	r.mutex.Unlock()
+}
+
+// schedule returns when the given credentials should be refreshed, picking a new jittered time
+// every time the role gets new credentials, never before half their lifetime.
+func (r *Refresher) schedule(entry cachedCredentials) scheduledRefresh {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if refresh, ok := r.refreshAt[entry.key]; ok && refresh.expiration.Equal(entry.expiration) {
+		return refresh
+	}
+
+	var jitter time.Duration
+	if r.Jitter > 0 {
+		jitter = time.Duration(rand.Int63n(int64(r.Jitter)))
+	}
+
+	before := r.RefreshBefore + jitter
+	if lifetime := entry.expiration.Sub(entry.issued); before > lifetime/2 {
+		before = lifetime / 2
+	}
+
+	return scheduledRefresh{
+		expiration: entry.expiration,
+		at:         entry.expiration.Add(-before),
+	}
+}
+
+// retry returns when to refresh again credentials whose refresh just failed.
+func (r *Refresher) retry(refresh scheduledRefresh, now time.Time) scheduledRefresh {
+	delay := r.MaxRetryDelay
+	if refresh.failures < 32 && r.RetryDelay<<refresh.failures < r.MaxRetryDelay {
+		delay = r.RetryDelay << refresh.failures
+	}
+
+	refresh.at = now.Add(delay)
+	refresh.failures++
+	return refresh
+}
@@ -0,0 +1,202 @@
+package credentials
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/schibsted/smaug/role"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRefresherRenewsCredentialsBeforeTheyExpire(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(30*time.Minute)))
+	repo := NewDefaultCredentialsRepository(stub)
+
+	_, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+	elapse(repo, 20*time.Minute)
+
+	stub.SetCredentials(getStsCredentials("OtherKey", time.Now().Add(60*time.Minute)))
+	refresher := NewRefresher(repo, fastRefresher)
+	refresher.Start()
+	defer refresher.Stop()
+
+	assertEventually(t, func() bool {
+		creds, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+		return err == nil && creds.AccessKeyID == "OtherKey"
+	})
+}
+
+func TestRefresherKeepsValidCredentialsIfRefreshFails(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(30*time.Minute)))
+	repo := NewDefaultCredentialsRepository(stub)
+
+	_, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+	elapse(repo, 20*time.Minute)
+
+	stub.SetError(errors.Errorf("Throttling"))
+	refresher := NewRefresher(repo, fastRefresher)
+	refresher.Start()
+
+	assertEventually(t, func() bool { return stub.Calls() > 2 })
+	refresher.Stop()
+
+	creds, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+	assert.Equal(t, "Key", creds.AccessKeyID)
+}
+
+func TestRefresherBacksOffAfterFailedRefresh(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(30*time.Minute)))
+	repo := NewDefaultCredentialsRepository(stub)
+
+	_, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+	elapse(repo, 20*time.Minute)
+
+	stub.SetError(errors.Errorf("Throttling"))
+	refresher := NewRefresher(repo, fastRefresher, func(r *Refresher) {
+		r.RetryDelay = time.Minute
+	})
+	for i := 0; i < 5; i++ {
+		refresher.refreshExpiring()
+	}
+	assert.Equal(t, 2, stub.Calls())
+
+	refresh := refresher.refreshAt[cacheKey(role.NewRole(roleArn))]
+	assert.Equal(t, uint(1), refresh.failures)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), refresh.at, time.Second)
+
+	refresh = refresher.retry(refresher.retry(refresh, time.Now()), time.Now())
+	assert.WithinDuration(t, time.Now().Add(4*time.Minute), refresh.at, time.Second)
+	refresh = refresher.retry(refresher.retry(refresh, time.Now()), time.Now())
+	assert.WithinDuration(t, time.Now().Add(DefaultMaxRefreshRetryDelay), refresh.at, time.Second)
+}
+
+func TestRefresherDoesNotRenewIdleRoles(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(30*time.Minute)))
+	repo := NewDefaultCredentialsRepository(stub)
+
+	_, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+
+	refresher := NewRefresher(repo, fastRefresher, func(r *Refresher) {
+		r.IdleTimeout = time.Nanosecond
+	})
+	refresher.Start()
+	time.Sleep(50 * time.Millisecond)
+	refresher.Stop()
+
+	assert.Equal(t, 1, stub.Calls())
+}
+
+func TestRefresherDropsExpiredCredentialsOfIdleRoles(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(50*time.Millisecond)))
+	repo := NewDefaultCredentialsRepository(stub, func(r *DefaultCredentialsRepository) {
+		r.MinimumLifetime = 0
+	})
+
+	_, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+
+	refresher := NewRefresher(repo, fastRefresher, func(r *Refresher) {
+		r.IdleTimeout = time.Nanosecond
+	})
+	refresher.Start()
+	defer refresher.Stop()
+
+	assertEventually(t, func() bool { return len(repo.cached()) == 0 })
+}
+
+func TestRefresherSpreadsRefreshesWithJitter(t *testing.T) {
+	expiration := time.Now().Add(60 * time.Minute)
+	refresher := NewRefresher(NewDefaultCredentialsRepository(&MockSTSClient{}), func(r *Refresher) {
+		r.RefreshBefore = 10 * time.Minute
+		r.Jitter = 5 * time.Minute
+	})
+
+	for i := 0; i < 20; i++ {
+		refresh := refresher.schedule(cachedCredentials{key: "role", expiration: expiration})
+		assert.False(t, refresh.at.After(expiration.Add(-10*time.Minute)))
+		assert.True(t, refresh.at.After(expiration.Add(-15*time.Minute)))
+	}
+}
+
+func TestRefresherRenewsShortLivedRolesOnceHalfwayThroughTheirLifetime(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(15*time.Minute)))
+	repo := NewDefaultCredentialsRepository(stub)
+
+	_, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+
+	refresher := NewRefresher(repo)
+	for i := 0; i < 5; i++ {
+		refresher.refreshExpiring()
+	}
+	assert.Equal(t, 1, stub.Calls())
+
+	elapse(repo, 8*time.Minute)
+	stub.SetCredentials(getStsCredentials("OtherKey", time.Now().Add(15*time.Minute)))
+	for i := 0; i < 5; i++ {
+		refresher.refreshExpiring()
+	}
+	assert.Equal(t, 2, stub.Calls())
+}
+
+func TestRefresherCapsRefreshBeforeAtHalfTheLifetime(t *testing.T) {
+	issued := time.Now()
+	expiration := issued.Add(15 * time.Minute)
+	refresher := NewRefresher(NewDefaultCredentialsRepository(&MockSTSClient{}))
+
+	refresh := refresher.schedule(cachedCredentials{key: "role", issued: issued, expiration: expiration})
+	assert.Equal(t, issued.Add(7*time.Minute+30*time.Second), refresh.at)
+}
+
+// elapse moves the cached credentials back in time by d, as if they were assumed d ago.
+func elapse(repo *DefaultCredentialsRepository, d time.Duration) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	for _, cached := range repo.credentials {
+		cached.issued = cached.issued.Add(-d)
+		cached.expiration = cached.expiration.Add(-d)
+	}
+}
+
+func fastRefresher(r *Refresher) {
+	r.Interval = 5 * time.Millisecond
+	r.RefreshBefore = 45 * time.Minute
+	r.Jitter = 0
+	r.RetryDelay = time.Millisecond
+}
+
+func assertEventually(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Error("Condition was not met in time")
+}
@@ -1,69 +1,335 @@
 package credentials
 
 import (
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/go-errors/errors"
+	"github.com/schibsted/smaug/role"
 	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// DefaultDuration is how long the assumed role credentials are requested for.
+	DefaultDuration = 1 * time.Hour
+	// DefaultMinimumLifetime is the least time credentials must still be valid for to be handed out.
+	DefaultMinimumLifetime = 5 * time.Minute
+
+	// StsFailureWindow is how long a failed STS call makes STS unhealthy when no call succeeds after it.
+	StsFailureWindow = 1 * time.Minute
+
+	maximumChainedDuration = role.MaximumChainedDuration
+)
+
 type CredentialsRepository interface {
-	FindCredentialsByRoleArn(string) (*SmaugCredentials, error)
+	FindCredentialsByRole(*role.Role) (*SmaugCredentials, error)
 }
 
 // Default Credentials Repository
-func NewDefaultCredentialsRepository(client stsiface.STSAPI) *DefaultCredentialsRepository {
-	credentialsProviders := make(map[string]*credentials.Credentials)
-	return &DefaultCredentialsRepository{
-		client,
-		credentialsProviders,
+func NewDefaultCredentialsRepository(client stsiface.STSAPI, options ...func(*DefaultCredentialsRepository)) *DefaultCredentialsRepository {
+	repository := &DefaultCredentialsRepository{
+		client:                client,
+		Duration:              DefaultDuration,
+		MinimumLifetime:       DefaultMinimumLifetime,
+		ClientWithCredentials: clientWithCredentials(client),
+		credentials:           make(map[string]*cachedCredentials),
+	}
+
+	for _, option := range options {
+		option(repository)
 	}
+
+	return repository
 }
 
+// DefaultCredentialsRepository assumes roles through STS and caches the credentials until they
+// have less than MinimumLifetime left. Concurrent lookups of a role that isn't cached are merged
+// into a single AssumeRole call. Credentials are cached by role and options, so a role assumed
+// with different options gets different credentials.
+//
+// Roles with a hub role are assumed with the credentials of the hub role, which are cached like
+// the others, so the refresher renews them on their own.
 type DefaultCredentialsRepository struct {
-	client              stsiface.STSAPI
-	credentialsProvider map[string]*credentials.Credentials
+	client stsiface.STSAPI
+
+	// Duration of the assumed role credentials, for the roles that don't have their own.
+	Duration time.Duration
+
+	// MinimumLifetime credentials must have left to be returned from the cache.
+	MinimumLifetime time.Duration
+
+	// ClientWithCredentials returns an STS client calling with the given credentials, to assume roles
+	// with the credentials of their hub role.
+	ClientWithCredentials func(*SmaugCredentials) (stsiface.STSAPI, error)
+
+	mutex       sync.Mutex
+	credentials map[string]*cachedCredentials
+	flights     flightGroup
+	stsStatus   StsStatus
 }
 
-func (r *DefaultCredentialsRepository) FindCredentialsByRoleArn(roleArn string) (*SmaugCredentials, error) {
-	provider := &stscreds.AssumeRoleProvider{
-		Client:       r.client,
-		RoleARN:      roleArn,
-		Duration:     1 * time.Hour,
-		ExpiryWindow: 10 * time.Second,
+// StsStatus describes the last calls to STS.
+type StsStatus struct {
+	LastSuccess time.Time
+	LastFailure time.Time
+	// LastError is the error of the last failed call.
+	LastError error
+}
+
+// Healthy tells whether the last call to STS succeeded, or failed more than StsFailureWindow ago,
+// so a single failure doesn't last until the next call when there's no traffic.
+func (s StsStatus) Healthy() bool {
+	return !s.LastFailure.After(s.LastSuccess) || time.Since(s.LastFailure) >= StsFailureWindow
+}
+
+type cachedCredentials struct {
+	key         string
+	role        *role.Role
+	credentials *SmaugCredentials
+	issued      time.Time
+	expiration  time.Time
+	lastUsed    time.Time
+}
+
+func (c *cachedCredentials) validFor(lifetime time.Duration) bool {
+	return c.expiration.Sub(time.Now()) >= lifetime
+}
+
+func (r *DefaultCredentialsRepository) FindCredentialsByRole(role *role.Role) (*SmaugCredentials, error) {
+	if cached, ok := r.lookup(role); ok {
+		cacheLookups.WithLabelValues("hit").Inc()
+		return cached.credentials, nil
 	}
 
-	if _, ok := r.credentialsProvider[roleArn]; !ok {
-		r.credentialsProvider[roleArn] = credentials.NewCredentials(provider)
+	cacheLookups.WithLabelValues("miss").Inc()
+	cached, err := r.flights.Do(cacheKey(role), func() (*cachedCredentials, error) {
+		// A flight that ended after the lookup may have cached new credentials already.
+		if cached, ok := r.lookup(role); ok {
+			return cached, nil
+		}
+		return r.assumeRole(role)
+	})
+
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return cached.credentials, nil
+}
+
+// lookup returns the cached credentials of a role if they're valid for MinimumLifetime, marking
+// them as used.
+func (r *DefaultCredentialsRepository) lookup(role *role.Role) (*cachedCredentials, bool) {
+	r.mutex.Lock()
+	cached, ok := r.credentials[cacheKey(role)]
+	if ok {
+		cached.lastUsed = time.Now()
+	}
+	r.mutex.Unlock()
+
+	if !ok || !cached.validFor(r.MinimumLifetime) {
+		return nil, false
 	}
+	return cached, true
+}
+
+// refresh assumes the role again, merging concurrent refreshes of the same role. The cached
+// credentials are only replaced when the new ones are retrieved successfully.
+func (r *DefaultCredentialsRepository) refresh(role *role.Role) (*cachedCredentials, error) {
+	return r.flights.Do(cacheKey(role), func() (*cachedCredentials, error) {
+		return r.assumeRole(role)
+	})
+}
 
-	creds := r.credentialsProvider[roleArn]
+// cached returns a snapshot of the cached credentials.
+func (r *DefaultCredentialsRepository) cached() []cachedCredentials {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	jobCredentials, err := convertToValidCredentials(provider, creds)
+	entries := make([]cachedCredentials, 0, len(r.credentials))
+	for _, cached := range r.credentials {
+		entries = append(entries, *cached)
+	}
+	return entries
+}
 
-	return jobCredentials, err
+// evict drops the cached credentials with the given key, unless they were used after the given time.
+func (r *DefaultCredentialsRepository) evict(key string, unusedSince time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if cached, ok := r.credentials[key]; ok && !cached.lastUsed.After(unusedSince) {
+		delete(r.credentials, key)
+	}
 }
-func convertToValidCredentials(provider *stscreds.AssumeRoleProvider, creds *credentials.Credentials) (*SmaugCredentials, error) {
-	roleArn := provider.RoleARN
 
-	credsValue, err := creds.Get()
+func (r *DefaultCredentialsRepository) assumeRole(role *role.Role) (*cachedCredentials, error) {
+	// Templates expanded for a job may make a valid role invalid, like a session policy too long.
+	if err := role.Validate(); err != nil {
+		return nil, err
+	}
+
+	input := &sts.AssumeRoleInput{
+		DurationSeconds: aws.Int64(int64(r.Duration / time.Second)),
+		RoleArn:         aws.String(role.Arn),
+		RoleSessionName: aws.String(fmt.Sprintf("%d", time.Now().UTC().UnixNano())),
+	}
+	if role.Duration != 0 {
+		input.DurationSeconds = aws.Int64(int64(role.Duration / time.Second))
+	}
+	if role.ExternalId != "" {
+		input.ExternalId = aws.String(role.ExternalId)
+	}
+	if role.SessionName != "" {
+		input.RoleSessionName = aws.String(role.SessionName)
+	}
+	if role.Policy != "" {
+		input.Policy = aws.String(role.Policy)
+	}
+
+	client := r.client
+	if role.Via != "" {
+		var err error
+		if client, err = r.hubClient(role); err != nil {
+			return nil, &ChainStepError{1, role.Via, err}
+		}
+		if aws.Int64Value(input.DurationSeconds) > int64(maximumChainedDuration/time.Second) {
+			input.DurationSeconds = aws.Int64(int64(maximumChainedDuration / time.Second))
+		}
+	}
+
+	start := time.Now()
+	output, err := client.AssumeRole(input)
+	assumeRoleDuration.Observe(time.Since(start).Seconds())
 
 	if err != nil {
-		log.Error(err)
+		err = classifyStsError(role.Arn, err)
+		assumeRoleCalls.WithLabelValues(errorClass(err)).Inc()
+		r.recordStsCall(err)
+		if role.Via != "" {
+			return nil, &ChainStepError{2, role.Arn, err}
+		}
+		return nil, err
+	}
+	assumeRoleCalls.WithLabelValues(errorClass(nil)).Inc()
+	r.recordStsCall(nil)
+
+	cached, err := convertToValidCredentials(role, output.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	cached.credentials.SessionName = aws.StringValue(input.RoleSessionName)
+	if !cached.validFor(r.MinimumLifetime) {
+		return nil, errors.Errorf("Credentials for role %s expire at %s, before the minimum lifetime of %s", role.Arn, cached.credentials.Expiration, r.MinimumLifetime)
+	}
+
+	r.mutex.Lock()
+	cached.lastUsed = time.Now()
+	if previous, ok := r.credentials[cached.key]; ok {
+		cached.lastUsed = previous.lastUsed
+	}
+	r.credentials[cached.key] = cached
+	r.mutex.Unlock()
+
+	return cached, nil
+}
+
+// hubClient returns an STS client with the credentials of the hub role of a role.
+func (r *DefaultCredentialsRepository) hubClient(chained *role.Role) (stsiface.STSAPI, error) {
+	hub := &role.Role{Arn: chained.Via, SessionName: SharedSessionName}
+	hubCredentials, err := r.FindCredentialsByRole(hub)
+	if err != nil {
 		return nil, err
 	}
+	return r.ClientWithCredentials(hubCredentials)
+}
+
+// Probe checks that STS can be reached with the base credentials through GetCallerIdentity.
+func (r *DefaultCredentialsRepository) Probe() error {
+	_, err := r.client.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		err = classifyStsError("", err)
+	}
+	r.recordStsCall(err)
+	return err
+}
+
+// StsStatus returns how the last calls to STS went.
+func (r *DefaultCredentialsRepository) StsStatus() StsStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.stsStatus
+}
+
+func (r *DefaultCredentialsRepository) recordStsCall(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Access denied is about the role and throttling about the rate of calls, STS answered either way.
+	switch err.(type) {
+	case nil, *AssumeRoleDeniedError, *ThrottledError:
+		r.stsStatus.LastSuccess = time.Now()
+		return
+	}
+	r.stsStatus.LastFailure = time.Now()
+	r.stsStatus.LastError = err
+}
+
+// clientWithCredentials returns clients configured like the given one, but with other credentials.
+func clientWithCredentials(base stsiface.STSAPI) func(*SmaugCredentials) (stsiface.STSAPI, error) {
+	return func(creds *SmaugCredentials) (stsiface.STSAPI, error) {
+		static := awscredentials.NewStaticCredentials(creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken)
+		if client, ok := base.(*StsClient); ok {
+			return client.WithCredentials(static), nil
+		}
+
+		config := aws.NewConfig()
+		if client, ok := base.(*sts.STS); ok {
+			config = client.Client.Config.Copy()
+		}
+		config.Credentials = static
+
+		sess, err := session.NewSession(config)
+		if err != nil {
+			return nil, err
+		}
+		return sts.New(sess), nil
+	}
+}
+
+// cacheKey identifies the credentials of a role assumed with the same options.
+func cacheKey(role *role.Role) string {
+	return strings.Join([]string{role.Arn, role.Duration.String(), role.ExternalId, role.SessionName, role.Policy, role.Via}, "\x00")
+}
+
+func convertToValidCredentials(role *role.Role, creds *sts.Credentials) (*cachedCredentials, error) {
+	if creds == nil || creds.Expiration == nil {
+		return nil, &UpstreamUnavailableError{role.Arn, 0, errors.Errorf("AssumeRole answered without credentials")}
+	}
 
-	expirationTime := time.Now().Add(provider.Duration).Add(-provider.ExpiryWindow)
-	expiry := expirationTime.Format("2006-01-02T15:04:05Z")
+	expiration := aws.TimeValue(creds.Expiration).UTC()
 
 	smaugCredentials := &SmaugCredentials{
-		roleArn,
-		credsValue.AccessKeyID,
-		credsValue.SecretAccessKey,
-		credsValue.SessionToken,
-		expiry,
+		RoleArn:         role.Arn,
+		AccessKeyID:     aws.StringValue(creds.AccessKeyId),
+		SecretAccessKey: aws.StringValue(creds.SecretAccessKey),
+		SessionToken:    aws.StringValue(creds.SessionToken),
+		Expiration:      expiration.Format(time.RFC3339),
+		LastUpdated:     time.Now().UTC().Format(time.RFC3339),
 	}
 
-	return smaugCredentials, nil
+	return &cachedCredentials{
+		key:         cacheKey(role),
+		role:        role,
+		credentials: smaugCredentials,
+		issued:      time.Now(),
+		expiration:  expiration,
+	}, nil
 }
@@ -2,9 +2,12 @@ package credentials
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/schibsted/smaug/role"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 	"time"
 )
@@ -26,24 +29,334 @@ func TestDefaultCredentialsRepositoryFindCredentialsReturnsCredentialsFromAssume
 
 	repo := NewDefaultCredentialsRepository(stub)
 
-	creds, err := repo.FindCredentialsByRoleArn(roleArn)
+	creds, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
 	assert.Nil(t, err)
 
 	assert.Equal(t, *expectedCredentials.AccessKeyId, creds.AccessKeyID)
 	assert.Equal(t, *expectedCredentials.SecretAccessKey, creds.SecretAccessKey)
 	assert.Equal(t, *expectedCredentials.SessionToken, creds.SessionToken)
+	assert.Equal(t, expiry.UTC().Format(time.RFC3339), creds.Expiration)
+}
+
+func TestDefaultCredentialsRepositoryFindCredentialsReturnsExpirationFromStsInUTC(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	expiry := time.Date(2030, 4, 11, 23, 49, 0, 0, time.FixedZone("CEST", 2*60*60))
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", expiry))
+
+	repo := NewDefaultCredentialsRepository(stub)
+
+	creds, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+	assert.Equal(t, "2030-04-11T21:49:00Z", creds.Expiration)
+}
+
+func TestDefaultCredentialsRepositoryFindCredentialsReturnsCachedCredentials(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(60*time.Minute)))
+
+	repo := NewDefaultCredentialsRepository(stub)
+
+	first, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+
+	stub.SetCredentials(getStsCredentials("OtherKey", time.Now().Add(60*time.Minute)))
+	second, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, stub.Calls())
+}
+
+func TestDefaultCredentialsRepositoryFindCredentialsRenewsCredentialsUnderMinimumLifetime(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(15*time.Minute)))
+
+	repo := NewDefaultCredentialsRepository(stub, func(r *DefaultCredentialsRepository) {
+		r.MinimumLifetime = 10 * time.Minute
+	})
+
+	_, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+
+	repo.MinimumLifetime = 20 * time.Minute
+	stub.SetCredentials(getStsCredentials("OtherKey", time.Now().Add(60*time.Minute)))
+
+	creds, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Nil(t, err)
+	assert.Equal(t, "OtherKey", creds.AccessKeyID)
+	assert.Equal(t, 2, stub.Calls())
+}
+
+func TestDefaultCredentialsRepositoryFindCredentialsReturnsErrorIfNewCredentialsAreUnderMinimumLifetime(t *testing.T) {
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(2*time.Minute)))
+
+	repo := NewDefaultCredentialsRepository(stub)
+
+	creds, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+	assert.Error(t, err)
+	assert.Nil(t, creds)
+}
+
+func TestDefaultCredentialsRepositoryFindCredentialsAssumesRoleOnceForConcurrentRequests(t *testing.T) {
+	roleArns := []string{"arn:aws:iam::111111111:myrole/role", "arn:aws:iam::111111111:myrole/other"}
+
+	expiry := time.Now().Add(60 * time.Minute)
+	stub := &MockSTSClient{delay: 10 * time.Millisecond}
+	stub.SetCredentials(getStsCredentials("Key", expiry))
+
+	repo := NewDefaultCredentialsRepository(stub)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		roleArn := roleArns[i%len(roleArns)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			creds, err := repo.FindCredentialsByRole(role.NewRole(roleArn))
+			if assert.Nil(t, err) {
+				assert.Equal(t, roleArn, creds.RoleArn)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, len(roleArns), stub.Calls())
+}
+
+func TestDefaultCredentialsRepositoryFindCredentialsReturnsErrorIfStsAnswersWithoutCredentials(t *testing.T) {
+	stub := &MockSTSClient{}
+
+	repo := NewDefaultCredentialsRepository(stub)
+
+	creds, err := repo.FindCredentialsByRole(role.NewRole("arn:aws:iam::111111111:myrole/role"))
+	assert.IsType(t, &UpstreamUnavailableError{}, err)
+	assert.Nil(t, creds)
+}
+
+func TestDefaultCredentialsRepositoryTracksStsStatus(t *testing.T) {
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(60*time.Minute)))
+	repo := NewDefaultCredentialsRepository(stub)
+
+	assert.True(t, repo.StsStatus().Healthy())
+
+	repo.FindCredentialsByRole(role.NewRole("arn:aws:iam::111111111:myrole/role"))
+	assert.True(t, repo.StsStatus().Healthy())
+	assert.False(t, repo.StsStatus().LastSuccess.IsZero())
+
+	stub.SetError(awserr.New("RequestError", "send request failed", nil))
+	assert.Error(t, repo.Probe())
+	assert.False(t, repo.StsStatus().Healthy())
+	assert.IsType(t, &UpstreamUnavailableError{}, repo.StsStatus().LastError)
+
+	stub.SetError(nil)
+	assert.Nil(t, repo.Probe())
+	assert.True(t, repo.StsStatus().Healthy())
+}
+
+func TestDefaultCredentialsRepositoryAccessDeniedDoesNotMakeStsUnhealthy(t *testing.T) {
+	stub := &MockSTSClient{}
+	stub.SetError(awserr.NewRequestFailure(awserr.New("AccessDenied", "Not authorized", nil), 403, "id"))
+	repo := NewDefaultCredentialsRepository(stub)
+
+	repo.FindCredentialsByRole(role.NewRole("arn:aws:iam::111111111:myrole/role"))
+
+	assert.True(t, repo.StsStatus().Healthy())
+}
+
+func TestDefaultCredentialsRepositoryThrottlingDoesNotMakeStsUnhealthy(t *testing.T) {
+	stub := &MockSTSClient{}
+	stub.SetError(awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "id"))
+	repo := NewDefaultCredentialsRepository(stub)
+
+	repo.FindCredentialsByRole(role.NewRole("arn:aws:iam::111111111:myrole/role"))
+
+	assert.True(t, repo.StsStatus().Healthy())
+}
+
+func TestStsStatusForgetsFailuresAfterWindow(t *testing.T) {
+	now := time.Now()
+
+	assert.False(t, StsStatus{LastSuccess: now.Add(-time.Hour), LastFailure: now}.Healthy())
+	assert.False(t, StsStatus{LastFailure: now.Add(-StsFailureWindow / 2)}.Healthy())
+	assert.True(t, StsStatus{LastSuccess: now.Add(-time.Hour), LastFailure: now.Add(-StsFailureWindow)}.Healthy())
+}
+
+func TestDefaultCredentialsRepositoryExpiredTokenMakesStsUnhealthy(t *testing.T) {
+	stub := &MockSTSClient{}
+	stub.SetError(awserr.NewRequestFailure(awserr.New("ExpiredTokenException", "The security token included in the request is expired", nil), 400, "id"))
+	repo := NewDefaultCredentialsRepository(stub)
+
+	_, err := repo.FindCredentialsByRole(role.NewRole("arn:aws:iam::111111111:myrole/role"))
+
+	assert.IsType(t, &UpstreamUnavailableError{}, err)
+	assert.False(t, repo.StsStatus().Healthy())
+}
+
+func TestDefaultCredentialsRepositoryAssumesRoleWithItsOptions(t *testing.T) {
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(12*time.Hour)))
+
+	repo := NewDefaultCredentialsRepository(stub)
+
+	_, err := repo.FindCredentialsByRole(&role.Role{
+		Arn:         "arn:aws:iam::111111111:myrole/role",
+		Duration:    12 * time.Hour,
+		ExternalId:  "my-external-id",
+		SessionName: "batch-myjob",
+		Policy:      `{"Version":"2012-10-17","Statement":[]}`,
+	})
+	assert.Nil(t, err)
+
+	input := stub.LastInput()
+	assert.Equal(t, int64(12*60*60), aws.Int64Value(input.DurationSeconds))
+	assert.Equal(t, "my-external-id", aws.StringValue(input.ExternalId))
+	assert.Equal(t, "batch-myjob", aws.StringValue(input.RoleSessionName))
+	assert.Equal(t, `{"Version":"2012-10-17","Statement":[]}`, aws.StringValue(input.Policy))
+}
+
+func TestDefaultCredentialsRepositoryDoesNotShareCredentialsBetweenOptions(t *testing.T) {
+	stub := &MockSTSClient{}
+	stub.SetCredentials(getStsCredentials("Key", time.Now().Add(60*time.Minute)))
+
+	repo := NewDefaultCredentialsRepository(stub)
+
+	repo.FindCredentialsByRole(&role.Role{Arn: "arn:aws:iam::111111111:myrole/role", ExternalId: "first"})
+	repo.FindCredentialsByRole(&role.Role{Arn: "arn:aws:iam::111111111:myrole/role", ExternalId: "second"})
+	repo.FindCredentialsByRole(&role.Role{Arn: "arn:aws:iam::111111111:myrole/role", ExternalId: "first"})
+	repo.FindCredentialsByRole(&role.Role{Arn: "arn:aws:iam::111111111:myrole/role", ExternalId: "first", Policy: `{"Statement":[]}`})
+
+	assert.Equal(t, 3, stub.Calls())
+}
+
+func TestDefaultCredentialsRepositoryAssumesRoleWithCredentialsOfHubRole(t *testing.T) {
+	hub := &MockSTSClient{}
+	hub.SetCredentials(getStsCredentials("HubKey", time.Now().Add(60*time.Minute)))
+	chained := &MockSTSClient{}
+	chained.SetCredentials(getStsCredentials("Key", time.Now().Add(60*time.Minute)))
+
+	var hubKeys []string
+	repo := NewDefaultCredentialsRepository(hub, func(r *DefaultCredentialsRepository) {
+		r.Duration = 4 * time.Hour
+		r.ClientWithCredentials = func(creds *SmaugCredentials) (stsiface.STSAPI, error) {
+			hubKeys = append(hubKeys, creds.AccessKeyID)
+			return chained, nil
+		}
+	})
+
+	creds, err := repo.FindCredentialsByRole(&role.Role{Arn: "arn:aws:iam::222222222:role/target", Via: "arn:aws:iam::111111111:role/hub"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Key", creds.AccessKeyID)
+	assert.Equal(t, "arn:aws:iam::111111111:role/hub", aws.StringValue(hub.LastInput().RoleArn))
+	assert.Equal(t, "arn:aws:iam::222222222:role/target", aws.StringValue(chained.LastInput().RoleArn))
+	assert.Equal(t, int64(60*60), aws.Int64Value(chained.LastInput().DurationSeconds))
+
+	_, err = repo.FindCredentialsByRole(&role.Role{Arn: "arn:aws:iam::333333333:role/other", Via: "arn:aws:iam::111111111:role/hub"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, hub.Calls())
+	assert.Equal(t, 2, chained.Calls())
+	assert.Equal(t, []string{"HubKey", "HubKey"}, hubKeys)
+}
+
+func TestDefaultCredentialsRepositoryReportsFailingStepOfRoleChain(t *testing.T) {
+	denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "Not authorized", nil), 403, "request")
+	hub := &MockSTSClient{}
+	chained := &MockSTSClient{}
+	repo := NewDefaultCredentialsRepository(hub, func(r *DefaultCredentialsRepository) {
+		r.ClientWithCredentials = func(*SmaugCredentials) (stsiface.STSAPI, error) {
+			return chained, nil
+		}
+	})
+	target := &role.Role{Arn: "arn:aws:iam::222222222:role/target", Via: "arn:aws:iam::111111111:role/hub"}
+
+	hub.SetError(denied)
+	_, err := repo.FindCredentialsByRole(target)
+	if assert.IsType(t, &ChainStepError{}, err) {
+		assert.Equal(t, 1, err.(*ChainStepError).Step)
+		assert.Equal(t, "arn:aws:iam::111111111:role/hub", err.(*ChainStepError).RoleArn)
+		assert.IsType(t, &AssumeRoleDeniedError{}, err.(*ChainStepError).Unwrap())
+	}
+
+	hub.SetError(nil)
+	hub.SetCredentials(getStsCredentials("HubKey", time.Now().Add(60*time.Minute)))
+	chained.SetError(denied)
+	_, err = repo.FindCredentialsByRole(target)
+	if assert.IsType(t, &ChainStepError{}, err) {
+		assert.Equal(t, 2, err.(*ChainStepError).Step)
+		assert.Equal(t, "arn:aws:iam::222222222:role/target", err.(*ChainStepError).RoleArn)
+		assert.IsType(t, &AssumeRoleDeniedError{}, err.(*ChainStepError).Unwrap())
+	}
+}
+
+func getStsCredentials(accessKey string, expiry time.Time) *sts.Credentials {
+	return &sts.Credentials{
+		AccessKeyId:     aws.String(accessKey),
+		SecretAccessKey: aws.String("Secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      &expiry,
+	}
 }
 
 type MockSTSClient struct {
 	stsiface.STSAPI
+	mutex sync.Mutex
 	creds *sts.Credentials
+	err   error
+	delay time.Duration
+	calls int
+	input *sts.AssumeRoleInput
 }
 
 func (m *MockSTSClient) SetCredentials(creds *sts.Credentials) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.creds = creds
 }
+func (m *MockSTSClient) SetError(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.err = err
+}
+func (m *MockSTSClient) Calls() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.calls
+}
+func (m *MockSTSClient) LastInput() *sts.AssumeRoleInput {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.input
+}
+func (m *MockSTSClient) GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:iam::111111111:role/smaug")}, nil
+}
 func (m *MockSTSClient) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	m.mutex.Lock()
+	m.calls++
+	m.input = input
+	creds, err := m.creds, m.err
+	m.mutex.Unlock()
+
+	time.Sleep(m.delay)
+	if err != nil {
+		return nil, err
+	}
 	return &sts.AssumeRoleOutput{
-		Credentials: m.creds,
+		Credentials: creds,
 	}, nil
 }
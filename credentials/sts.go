@@ -0,0 +1,169 @@
+package credentials
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/go-errors/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultStsRegion is the region STS is called in when none is configured.
+	DefaultStsRegion = "eu-west-1"
+
+	// CredentialsFromDefaultChain takes the base credentials from the environment, the shared
+	// credentials file or the instance role, whichever is found first.
+	CredentialsFromDefaultChain = "default"
+	// CredentialsFromKeysFile takes the base credentials from the default profile of a keys file,
+	// in the format of the shared credentials file.
+	CredentialsFromKeysFile = "keys-file"
+	// CredentialsFromProfile takes the base credentials from a named profile of the shared config.
+	CredentialsFromProfile = "profile"
+	// CredentialsFromInstanceRole takes the base credentials from the EC2 instance role.
+	CredentialsFromInstanceRole = "instance-role"
+)
+
+// StsConfig tells how to reach STS and which base credentials to assume roles with.
+type StsConfig struct {
+	// Region of STS, DefaultStsRegion if empty.
+	Region string
+
+	// RegionalEndpoint calls sts.<region>.amazonaws.com instead of the global sts.amazonaws.com.
+	RegionalEndpoint bool
+
+	// Endpoint is the url of STS, overriding the one of the region.
+	Endpoint string
+
+	// FallbackRegions are the regions whose regional endpoints are called in order when the
+	// previous ones can't be reached.
+	FallbackRegions []string
+
+	// CredentialsSource is one of the CredentialsFrom constants, CredentialsFromDefaultChain if empty.
+	CredentialsSource string
+
+	// KeysFile holds the keys for CredentialsFromKeysFile.
+	KeysFile string
+
+	// Profile is the profile for CredentialsFromProfile.
+	Profile string
+}
+
+// NewStsClient returns an STS client as described by the config.
+func NewStsClient(config StsConfig) (*StsClient, error) {
+	region := config.Region
+	if region == "" {
+		region = DefaultStsRegion
+	}
+
+	sess, err := newBaseSession(config)
+	if err != nil {
+		return nil, err
+	}
+
+	primary := aws.NewConfig().WithRegion(region)
+	switch {
+	case config.Endpoint != "":
+		primary.Endpoint = aws.String(config.Endpoint)
+	case config.RegionalEndpoint:
+		primary.Endpoint = aws.String(regionalEndpoint(region))
+	}
+
+	configs := []*aws.Config{primary}
+	for _, fallback := range config.FallbackRegions {
+		configs = append(configs, aws.NewConfig().WithRegion(fallback).WithEndpoint(regionalEndpoint(fallback)))
+	}
+
+	return newStsClient(sess, configs), nil
+}
+
+func newBaseSession(config StsConfig) (*session.Session, error) {
+	switch config.CredentialsSource {
+	case "", CredentialsFromDefaultChain:
+		return session.NewSession()
+	case CredentialsFromKeysFile:
+		if config.KeysFile == "" {
+			return nil, errors.Errorf("A keys file is required for the %s credentials source", CredentialsFromKeysFile)
+		}
+		credentials := awscredentials.NewSharedCredentials(config.KeysFile, "default")
+		if _, err := credentials.Get(); err != nil {
+			return nil, errors.Errorf("Could not read keys from %s: %s", config.KeysFile, err)
+		}
+		return session.NewSession(aws.NewConfig().WithCredentials(credentials))
+	case CredentialsFromProfile:
+		if config.Profile == "" {
+			return nil, errors.Errorf("A profile is required for the %s credentials source", CredentialsFromProfile)
+		}
+		return session.NewSessionWithOptions(session.Options{Profile: config.Profile, SharedConfigState: session.SharedConfigEnable})
+	case CredentialsFromInstanceRole:
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return session.NewSession(aws.NewConfig().WithCredentials(ec2rolecreds.NewCredentials(sess)))
+	}
+
+	return nil, errors.Errorf("Unknown credentials source: %s", config.CredentialsSource)
+}
+
+func regionalEndpoint(region string) string {
+	return fmt.Sprintf("https://sts.%s.amazonaws.com", region)
+}
+
+func newStsClient(sess *session.Session, configs []*aws.Config) *StsClient {
+	client := &StsClient{session: sess, configs: configs}
+	for _, config := range configs {
+		client.clients = append(client.clients, sts.New(sess, config))
+	}
+	client.STSAPI = client.clients[0]
+	return client
+}
+
+// StsClient calls STS at its primary endpoint, and at the fallback endpoints in order when the
+// previous ones can't be reached.
+type StsClient struct {
+	stsiface.STSAPI
+
+	session *session.Session
+	configs []*aws.Config
+	clients []*sts.STS
+}
+
+func (c *StsClient) AssumeRole(input *sts.AssumeRoleInput) (output *sts.AssumeRoleOutput, err error) {
+	c.withFallback(func(client *sts.STS) error {
+		output, err = client.AssumeRole(input)
+		return err
+	})
+	return output, err
+}
+
+func (c *StsClient) GetCallerIdentity(input *sts.GetCallerIdentityInput) (output *sts.GetCallerIdentityOutput, err error) {
+	c.withFallback(func(client *sts.STS) error {
+		output, err = client.GetCallerIdentity(input)
+		return err
+	})
+	return output, err
+}
+
+// WithCredentials returns a client calling the same endpoints with other credentials.
+func (c *StsClient) WithCredentials(credentials *awscredentials.Credentials) *StsClient {
+	configs := make([]*aws.Config, 0, len(c.configs))
+	for _, config := range c.configs {
+		configs = append(configs, config.Copy().WithCredentials(credentials))
+	}
+	return newStsClient(c.session, configs)
+}
+
+func (c *StsClient) withFallback(call func(*sts.STS) error) {
+	for i, client := range c.clients {
+		err := call(client)
+		if _, unavailable := classifyStsError("", err).(*UpstreamUnavailableError); !unavailable || i == len(c.clients)-1 {
+			return
+		}
+		log.Warnf("STS at %s is unavailable, calling %s: %s", client.Endpoint, c.clients[i+1].Endpoint, err)
+	}
+}
@@ -0,0 +1,137 @@
+package credentials
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewStsClientCallsEndpointWithKeysFile(t *testing.T) {
+	fake := newFakeSts()
+	defer fake.Close()
+	keysFile := writeKeysFile(t, "[default]\naws_access_key_id = AKIDKEYSFILE\naws_secret_access_key = secret\n")
+	defer os.RemoveAll(filepath.Dir(keysFile))
+
+	client, err := NewStsClient(StsConfig{Endpoint: fake.URL, CredentialsSource: CredentialsFromKeysFile, KeysFile: keysFile})
+	assert.Nil(t, err)
+
+	output, err := client.AssumeRole(&sts.AssumeRoleInput{RoleArn: aws.String("arn:aws:iam::111111111:role/role"), RoleSessionName: aws.String("myjob")})
+	assert.Nil(t, err)
+	assert.Equal(t, "ASIAFAKESTS", aws.StringValue(output.Credentials.AccessKeyId))
+	assert.Contains(t, fake.LastAuthorization(), "Credential=AKIDKEYSFILE/")
+	assert.Contains(t, fake.LastAuthorization(), "/eu-west-1/sts/")
+}
+
+func TestNewStsClientRejectsInvalidCredentialsSources(t *testing.T) {
+	_, err := NewStsClient(StsConfig{CredentialsSource: "unknown"})
+	assert.Error(t, err)
+
+	_, err = NewStsClient(StsConfig{CredentialsSource: CredentialsFromKeysFile})
+	assert.Error(t, err)
+
+	_, err = NewStsClient(StsConfig{CredentialsSource: CredentialsFromKeysFile, KeysFile: "missing"})
+	assert.Error(t, err)
+
+	_, err = NewStsClient(StsConfig{CredentialsSource: CredentialsFromProfile})
+	assert.Error(t, err)
+}
+
+func TestNewStsClientUsesRegionalEndpoints(t *testing.T) {
+	client, err := NewStsClient(StsConfig{Region: "eu-central-1", RegionalEndpoint: true, FallbackRegions: []string{"eu-west-1"}})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "https://sts.eu-central-1.amazonaws.com", client.clients[0].Endpoint)
+	assert.Equal(t, "https://sts.eu-west-1.amazonaws.com", client.clients[1].Endpoint)
+}
+
+func TestStsClientFallsBackWhenEndpointIsUnreachable(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	fake := newFakeSts()
+	defer fake.Close()
+
+	sess := session.Must(session.NewSession(aws.NewConfig().WithMaxRetries(0).WithCredentials(staticTestCredentials)))
+	client := newStsClient(sess, []*aws.Config{
+		aws.NewConfig().WithRegion("eu-west-1").WithEndpoint(unreachable.URL),
+		aws.NewConfig().WithRegion("eu-central-1").WithEndpoint(fake.URL),
+	})
+
+	output, err := client.AssumeRole(&sts.AssumeRoleInput{RoleArn: aws.String("arn:aws:iam::111111111:role/role"), RoleSessionName: aws.String("myjob")})
+	assert.Nil(t, err)
+	assert.Equal(t, "ASIAFAKESTS", aws.StringValue(output.Credentials.AccessKeyId))
+	assert.Contains(t, fake.LastAuthorization(), "/eu-central-1/sts/")
+}
+
+func TestStsClientWithCredentialsKeepsEndpoints(t *testing.T) {
+	fake := newFakeSts()
+	defer fake.Close()
+
+	sess := session.Must(session.NewSession(aws.NewConfig().WithCredentials(staticTestCredentials)))
+	client := newStsClient(sess, []*aws.Config{aws.NewConfig().WithRegion("eu-west-1").WithEndpoint(fake.URL)})
+	hubClient, err := clientWithCredentials(client)(&SmaugCredentials{AccessKeyID: "ASIAHUB", SecretAccessKey: "secret", SessionToken: "token"})
+	assert.Nil(t, err)
+
+	_, err = hubClient.AssumeRole(&sts.AssumeRoleInput{RoleArn: aws.String("arn:aws:iam::111111111:role/role"), RoleSessionName: aws.String("myjob")})
+	assert.Nil(t, err)
+	assert.Contains(t, fake.LastAuthorization(), "Credential=ASIAHUB/")
+}
+
+var staticTestCredentials = awscredentials.NewStaticCredentials("AKIDTEST", "secret", "")
+
+type fakeSts struct {
+	*httptest.Server
+	mutex         sync.Mutex
+	authorization string
+}
+
+func newFakeSts() *fakeSts {
+	fake := &fakeSts{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mutex.Lock()
+		fake.authorization = r.Header.Get("Authorization")
+		fake.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIAFAKESTS</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2030-04-11T21:49:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+  <ResponseMetadata><RequestId>request</RequestId></ResponseMetadata>
+</AssumeRoleResponse>`))
+	}))
+	return fake
+}
+
+func (f *fakeSts) LastAuthorization() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.authorization
+}
+
+func writeKeysFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "smaug-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(path, []byte(strings.TrimSpace(content)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
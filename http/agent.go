@@ -0,0 +1,120 @@
+package http
+
+import (
+	"fmt"
+	"github.com/go-errors/errors"
+	"github.com/schibsted/smaug/role"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// AgentIdentityAddress identifies the caller by its source address, compared with the addresses
+	// of the agent hostname.
+	AgentIdentityAddress = "address"
+	// AgentIdentityCertificate identifies the caller by its verified client certificate, which must be
+	// valid for the agent hostname.
+	AgentIdentityCertificate = "certificate"
+)
+
+// AgentMismatchError is returned when credentials are requested by another caller than the agent
+// running the task of the job.
+type AgentMismatchError struct {
+	JobId  string
+	Caller string
+	// Agent is the hostname of the agent running the task, empty if it isn't known.
+	Agent string
+}
+
+func (e *AgentMismatchError) Error() string {
+	if e.Agent == "" {
+		return fmt.Sprintf("The agent running job %s is unknown, refusing %s", e.JobId, e.Caller)
+	}
+	return fmt.Sprintf("Job %s runs on agent %s, not on %s", e.JobId, e.Agent, e.Caller)
+}
+
+// Agent Binding
+//
+// AgentBinding only lets the agent running the task of a job get its credentials, so a compromised
+// agent can't get the credentials of the tasks of other agents. The task is found by the locator,
+// usually the Mesos role repository.
+func NewAgentBinding(locator role.TaskLocator, options ...func(*AgentBinding)) *AgentBinding {
+	binding := &AgentBinding{
+		locator:    locator,
+		Identity:   AgentIdentityAddress,
+		LookupHost: net.LookupHost,
+	}
+
+	for _, option := range options {
+		option(binding)
+	}
+
+	return binding
+}
+
+type AgentBinding struct {
+	locator role.TaskLocator
+
+	// Identity is AgentIdentityAddress or AgentIdentityCertificate.
+	Identity string
+
+	// LookupHost resolves the agent hostnames to addresses.
+	LookupHost func(host string) ([]string, error)
+}
+
+// Verify returns the task of the job, and an AgentMismatchError if the request doesn't come from its agent.
+// Jobs that aren't running tasks and agents that can't be resolved are errors too.
+func (b *AgentBinding) Verify(r *http.Request, jobId string) (*role.Task, error) {
+	task, err := b.locator.FindTask(jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	caller, matches, err := b.callerMatches(r, task.AgentHostname)
+	if err != nil {
+		return task, err
+	}
+	if !matches {
+		err := &AgentMismatchError{jobId, caller, task.AgentHostname}
+		log.Warn(err)
+		return task, err
+	}
+
+	return task, nil
+}
+
+// callerMatches returns the identity of the caller and whether it's the agent.
+func (b *AgentBinding) callerMatches(r *http.Request, agent string) (string, bool, error) {
+	if b.Identity == AgentIdentityCertificate {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			return "caller without client certificate at " + r.RemoteAddr, false, nil
+		}
+		certificate := r.TLS.VerifiedChains[0][0]
+		if agent == "" {
+			return certificate.Subject.String(), false, nil
+		}
+		return certificate.Subject.String(), certificate.VerifyHostname(agent) == nil || strings.EqualFold(certificate.Subject.CommonName, agent), nil
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	callerIp := net.ParseIP(host)
+	if callerIp == nil || agent == "" {
+		return host, false, nil
+	}
+
+	addresses, err := b.LookupHost(agent)
+	if err != nil {
+		return host, false, &role.SourceUnavailableError{Source: "DNS", Cause: errors.Errorf("Could not resolve agent %s: %s", agent, err)}
+	}
+	for _, address := range addresses {
+		if callerIp.Equal(net.ParseIP(address)) {
+			return host, true, nil
+		}
+	}
+	return host, false, nil
+}
@@ -0,0 +1,28 @@
+package http
+
+import (
+	"context"
+	"github.com/schibsted/smaug/audit"
+	"net/http"
+)
+
+type auditRecordKey struct{}
+
+// Audit records every request to handler in sink, including the ones refused before reaching it,
+// like unauthenticated or rate limited requests. The credentials handlers behind it fill the same
+// record instead of recording their own, jobId gives the job of the refused requests.
+func Audit(sink audit.Sink, handler http.Handler, jobId func(*http.Request) (string, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := newAuditRecord(r)
+		record.JobId, _ = jobId(r)
+		w.Header().Set(RequestIdHeader, record.RequestId)
+		recorder := &responseRecorder{ResponseWriter: w, status: 200}
+
+		handler.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditRecordKey{}, &record)))
+
+		if record.Outcome == "" {
+			record.Outcome = recorder.outcome()
+		}
+		sink.Record(record)
+	})
+}
@@ -0,0 +1,138 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/go-errors/errors"
+	"github.com/schibsted/smaug/audit"
+	"github.com/schibsted/smaug/credentials"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"regexp"
+)
+
+var (
+	ContainerUrlRegexExpression = "^/container-credentials/(.+)$"
+	TokenUrlRegexExpression     = "^/container-tokens/(.+)$"
+)
+
+// JobTokens issues the authorization token of every job, derived from a secret key so they
+// don't need to be stored and survive restarts as long as the key is kept.
+func NewJobTokens(key []byte) *JobTokens {
+	return &JobTokens{key}
+}
+
+type JobTokens struct {
+	key []byte
+}
+
+func (t *JobTokens) TokenForJob(jobId string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(jobId))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (t *JobTokens) Verify(jobId string, token string) bool {
+	return hmac.Equal([]byte(t.TokenForJob(jobId)), []byte(token))
+}
+
+// ContainerCredentialsHandler serves the credentials of a job like the ECS container credentials
+// endpoint, so tasks can set AWS_CONTAINER_CREDENTIALS_FULL_URI to /container-credentials/<job-id>
+// and AWS_CONTAINER_AUTHORIZATION_TOKEN to the token of the job.
+func NewContainerCredentialsHandler(provider credentials.CredentialsProvider, tokens *JobTokens, options ...func(*ContainerCredentialsHandler)) *ContainerCredentialsHandler {
+	handler := &ContainerCredentialsHandler{
+		credentialsIssuer: credentialsIssuer{credentialsProvider: provider, AuditSink: audit.NopSink{}},
+		tokens:            tokens,
+	}
+
+	for _, option := range options {
+		option(handler)
+	}
+
+	return handler
+}
+
+type ContainerCredentialsHandler struct {
+	credentialsIssuer
+	tokens *JobTokens
+}
+
+func (h *ContainerCredentialsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	record, done := h.startAudit(w, r)
+	defer done()
+
+	jobId, err := GetContainerJobIdFromRequest(r)
+	log.Debug("JobId: ", jobId)
+	record.JobId = jobId
+	if err != nil {
+		record.Outcome = ErrorCodeInvalidRequest
+		writeErrorResponse(ErrorCodeInvalidRequest, err.Error(), 404, w)
+		return
+	}
+
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		record.Outcome = ErrorCodeUnauthorized
+		writeErrorResponse(ErrorCodeUnauthorized, "Missing authorization token", 401, w)
+		return
+	}
+	if !h.tokens.Verify(jobId, token) {
+		record.Outcome = ErrorCodeAccessDenied
+		writeErrorResponse(ErrorCodeAccessDenied, errors.Errorf("Invalid authorization token for job: %s", jobId).Error(), 403, w)
+		return
+	}
+
+	smaugCredentials, ok := h.issueCredentials(w, r, jobId, record)
+	if !ok {
+		return
+	}
+
+	encoded, err := json.Marshal(smaugCredentials)
+	writeCredentials(w, "application/json", encoded, err, smaugCredentials, record)
+}
+
+// ContainerTokenHandler returns the authorization token of a job to the scheduler, which must
+// authenticate with its own token as "Bearer <token>".
+func NewContainerTokenHandler(tokens *JobTokens, schedulerToken string) *ContainerTokenHandler {
+	return &ContainerTokenHandler{tokens, schedulerToken}
+}
+
+type ContainerTokenHandler struct {
+	tokens         *JobTokens
+	schedulerToken string
+}
+
+func (h *ContainerTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.schedulerToken == "" || !hmac.Equal([]byte("Bearer "+h.schedulerToken), []byte(r.Header.Get("Authorization"))) {
+		writeErrorResponse(ErrorCodeAccessDenied, "Invalid scheduler token", 403, w)
+		return
+	}
+
+	jobId, err := getJobIdFromUrl(TokenUrlRegexExpression, r)
+	if err != nil {
+		writeErrorResponse(ErrorCodeInvalidRequest, err.Error(), 404, w)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	w.Write([]byte(h.tokens.TokenForJob(jobId)))
+}
+
+// GetContainerJobIdFromRequest returns the job requested on the container credentials endpoint.
+func GetContainerJobIdFromRequest(r *http.Request) (string, error) {
+	return getJobIdFromUrl(ContainerUrlRegexExpression, r)
+}
+
+func getJobIdFromUrl(expression string, r *http.Request) (string, error) {
+	UrlRegex := regexp.MustCompile(expression)
+
+	match := UrlRegex.FindStringSubmatch(r.URL.EscapedPath())
+
+	if match != nil {
+		return match[1], nil
+	}
+
+	return "", errors.Errorf("Couldn't get Job Id from request url: %s", r.URL)
+}
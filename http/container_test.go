@@ -0,0 +1,131 @@
+package http_test
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/schibsted/smaug/credentials"
+	http_pkg "github.com/schibsted/smaug/http"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJobTokensVerifyOnlyTokenOfTheJob(t *testing.T) {
+	tokens := http_pkg.NewJobTokens([]byte("secret"))
+
+	token := tokens.TokenForJob("myjob")
+
+	assert.True(t, tokens.Verify("myjob", token))
+	assert.False(t, tokens.Verify("otherjob", token))
+	assert.False(t, http_pkg.NewJobTokens([]byte("other")).Verify("myjob", token))
+}
+
+func TestContainerCredentialsHandlerReturnsErrorWithoutToken(t *testing.T) {
+	handler, _ := newContainerCredentialsHandler("myjob")
+	req, _ := http.NewRequest("GET", "/container-credentials/myjob", nil)
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	body, _ := ioutil.ReadAll(writer.Body)
+	assert.Equal(t, 401, writer.Code)
+	assert.Equal(t, `{"code":"Unauthorized","message":"Missing authorization token"}`, string(body))
+}
+
+func TestContainerCredentialsHandlerReturnsErrorIfTokenIsForAnotherJob(t *testing.T) {
+	handler, tokens := newContainerCredentialsHandler("myjob")
+	req, _ := http.NewRequest("GET", "/container-credentials/myjob", nil)
+	req.Header.Set("Authorization", tokens.TokenForJob("otherjob"))
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	body, _ := ioutil.ReadAll(writer.Body)
+	assert.Equal(t, 403, writer.Code)
+	assert.Equal(t, `{"code":"AccessDenied","message":"Invalid authorization token for job: myjob"}`, string(body))
+}
+
+func TestContainerCredentialsHandlerIsReadableByEndpointProvider(t *testing.T) {
+	handler, tokens := newContainerCredentialsHandler("myjob")
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	provider := newEndpointProvider(server.URL+"/container-credentials/myjob", tokens.TokenForJob("myjob"))
+
+	value, err := provider.Retrieve()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "Key", value.AccessKeyID)
+	assert.Equal(t, "Secret", value.SecretAccessKey)
+	assert.Equal(t, "Token", value.SessionToken)
+	assert.False(t, provider.IsExpired())
+}
+
+func TestContainerCredentialsHandlerErrorIsReadableByEndpointProvider(t *testing.T) {
+	handler, tokens := newContainerCredentialsHandler("myjob")
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	provider := newEndpointProvider(server.URL+"/container-credentials/myjob", tokens.TokenForJob("otherjob"))
+
+	_, err := provider.Retrieve()
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "AccessDenied")
+	}
+}
+
+func TestContainerTokenHandlerReturnsTokenOfJobToScheduler(t *testing.T) {
+	tokens := http_pkg.NewJobTokens([]byte("secret"))
+	handler := http_pkg.NewContainerTokenHandler(tokens, "scheduler")
+	req, _ := http.NewRequest("GET", "/container-tokens/myjob", nil)
+	req.Header.Set("Authorization", "Bearer scheduler")
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	body, _ := ioutil.ReadAll(writer.Body)
+	assert.Equal(t, 200, writer.Code)
+	assert.Equal(t, tokens.TokenForJob("myjob"), string(body))
+}
+
+func TestContainerTokenHandlerReturnsErrorIfSchedulerTokenIsInvalid(t *testing.T) {
+	tokens := http_pkg.NewJobTokens([]byte("secret"))
+	handler := http_pkg.NewContainerTokenHandler(tokens, "scheduler")
+	req, _ := http.NewRequest("GET", "/container-tokens/myjob", nil)
+	req.Header.Set("Authorization", "Bearer other")
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	assert.Equal(t, 403, writer.Code)
+}
+
+func newContainerCredentialsHandler(jobId string) (*http_pkg.ContainerCredentialsHandler, *http_pkg.JobTokens) {
+	credentialsProvider := credentials.NewInMemoryCredentialsProvider()
+	credentialsProvider.AddCredentials(jobId, &credentials.SmaugCredentials{
+		RoleArn:         "arn:aws:iam::111111111:role/role",
+		AccessKeyID:     "Key",
+		SecretAccessKey: "Secret",
+		SessionToken:    "Token",
+		Expiration:      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	})
+	tokens := http_pkg.NewJobTokens([]byte("secret"))
+
+	return http_pkg.NewContainerCredentialsHandler(credentialsProvider, tokens), tokens
+}
+
+func newEndpointProvider(endpoint string, token string) *endpointcreds.Provider {
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("eu-west-1")}))
+	return endpointcreds.NewProviderClient(*sess.Config, sess.Handlers, endpoint, func(p *endpointcreds.Provider) {
+		// The vendored SDK predates AWS_CONTAINER_AUTHORIZATION_TOKEN, send it like newer SDKs do.
+		p.Client.Handlers.Sign.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set("Authorization", token)
+		})
+	}).(*endpointcreds.Provider)
+}
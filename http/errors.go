@@ -0,0 +1,119 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/schibsted/smaug/credentials"
+	"github.com/schibsted/smaug/role"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// Error codes of the JSON error responses, clients can rely on them to decide whether to retry.
+const (
+	ErrorCodeInvalidRequest      = "InvalidRequest"
+	ErrorCodeUnauthorized        = "Unauthorized"
+	ErrorCodeAccessDenied        = "AccessDenied"
+	ErrorCodeAgentMismatch       = "AgentMismatch"
+	ErrorCodeUnknownJob          = "UnknownJob"
+	ErrorCodeTaskNotRunning      = "TaskNotRunning"
+	ErrorCodeAssumeRoleDenied    = "AssumeRoleDenied"
+	ErrorCodeThrottled           = "Throttled"
+	ErrorCodeRateLimited         = "RateLimited"
+	ErrorCodeUpstreamError       = "UpstreamError"
+	ErrorCodeUpstreamUnavailable = "UpstreamUnavailable"
+	ErrorCodeInternalError       = "InternalError"
+)
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ErrorStatus returns the HTTP status and the error code for an error returned by a
+// credentials.CredentialsProvider, looking at the errors it wraps.
+func ErrorStatus(err error) (int, string) {
+	for err != nil {
+		switch e := err.(type) {
+		case *role.UnknownJobError, *credentials.CredentialsNotFoundError:
+			return 404, ErrorCodeUnknownJob
+		case *role.TaskNotRunningError:
+			return 404, ErrorCodeTaskNotRunning
+		case *role.SourceUnavailableError:
+			return 503, ErrorCodeUpstreamUnavailable
+		case *AgentMismatchError:
+			return 403, ErrorCodeAgentMismatch
+		case *credentials.AssumeRoleDeniedError:
+			return 403, ErrorCodeAssumeRoleDenied
+		case *credentials.ThrottledError:
+			return 429, ErrorCodeThrottled
+		case *credentials.UpstreamUnavailableError:
+			if e.StatusCode != 0 {
+				return 502, ErrorCodeUpstreamError
+			}
+			return 503, ErrorCodeUpstreamUnavailable
+		}
+
+		wrapper, ok := err.(interface {
+			Unwrap() error
+		})
+		if !ok {
+			break
+		}
+		err = wrapper.Unwrap()
+	}
+
+	return 500, ErrorCodeInternalError
+}
+
+// roleArnOfError returns the role the error happened with, if it's known.
+func roleArnOfError(err error) string {
+	for err != nil {
+		if e, ok := err.(*credentials.RoleCredentialsError); ok {
+			return e.RoleArn
+		}
+
+		wrapper, ok := err.(interface {
+			Unwrap() error
+		})
+		if !ok {
+			break
+		}
+		err = wrapper.Unwrap()
+	}
+
+	return ""
+}
+
+func writeError(err error, writer http.ResponseWriter) {
+	returnCode, code := ErrorStatus(err)
+	log.Error(describeError(err))
+	writeJSONError(code, err.Error(), returnCode, writer)
+}
+
+func writeErrorResponse(code string, errorMessage string, returnCode int, writer http.ResponseWriter) {
+	log.Error(errorMessage)
+	writeJSONError(code, errorMessage, returnCode, writer)
+}
+
+func writeJSONError(code string, errorMessage string, returnCode int, writer http.ResponseWriter) {
+	encoded, _ := json.Marshal(&ErrorResponse{code, errorMessage})
+	writer.Header().Add("Content-Type", "application/json")
+	writer.WriteHeader(returnCode)
+	writer.Write(encoded)
+}
+
+// describeError returns the message of an error followed by the messages of the errors it wraps.
+func describeError(err error) string {
+	description := err.Error()
+	for {
+		wrapper, ok := err.(interface {
+			Unwrap() error
+		})
+		if !ok || wrapper.Unwrap() == nil {
+			return description
+		}
+		err = wrapper.Unwrap()
+		description += ": " + err.Error()
+	}
+}
@@ -2,56 +2,140 @@ package http
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/go-errors/errors"
+	"github.com/schibsted/smaug/audit"
 	"github.com/schibsted/smaug/credentials"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"regexp"
+	"time"
 )
 
 var (
 	UrlRegexExpression = "^/credentials/(.*)$"
 )
 
-func NewCredentialsProviderHandler(provider credentials.CredentialsProvider) *CredentialsProviderHandler {
-	return &CredentialsProviderHandler{provider}
+const (
+	// RequestIdHeader carries the id of a request, one is generated when it's missing.
+	RequestIdHeader = "X-Request-Id"
+)
+
+func NewCredentialsProviderHandler(provider credentials.CredentialsProvider, options ...func(*CredentialsProviderHandler)) *CredentialsProviderHandler {
+	handler := &CredentialsProviderHandler{
+		credentialsIssuer: credentialsIssuer{credentialsProvider: provider, AuditSink: audit.NopSink{}},
+	}
+
+	for _, option := range options {
+		option(handler)
+	}
+
+	return handler
 }
 
 type CredentialsProviderHandler struct {
-	credentialsProvider credentials.CredentialsProvider
+	credentialsIssuer
 }
 
 func (h *CredentialsProviderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	record, done := h.startAudit(w, r)
+	defer done()
+
 	JobId, err := GetJobIdFromRequest(r)
 	log.Debug("JobId: ", JobId)
+	record.JobId = JobId
 	if err != nil {
-		writeErrorResponse(err.Error(), 404, w)
+		record.Outcome = ErrorCodeInvalidRequest
+		writeErrorResponse(ErrorCodeInvalidRequest, err.Error(), 404, w)
 		return
 	}
 
-	smaugCredentials, err := h.credentialsProvider.GetCredentialsForJob(JobId)
-
-	if err != nil {
-		writeErrorResponse(err.Error(), 404, w)
+	smaugCredentials, ok := h.issueCredentials(w, r, JobId, record)
+	if !ok {
 		return
 	}
 
 	encoded, err := json.Marshal(smaugCredentials)
+	writeCredentials(w, "application/json", encoded, err, smaugCredentials, record)
+}
+
+// credentialsIssuer is shared by the handlers giving the credentials of jobs.
+type credentialsIssuer struct {
+	credentialsProvider credentials.CredentialsProvider
+
+	// AuditSink records every credentials request.
+	AuditSink audit.Sink
+
+	// AgentBinding, if set, refuses the credentials of jobs to other callers than their agents.
+	AgentBinding *AgentBinding
+}
+
+// startAudit returns the audit record of a request, and the function recording it once the
+// request is served. Behind Audit it's the record of Audit, which records it itself.
+func (i *credentialsIssuer) startAudit(w http.ResponseWriter, r *http.Request) (*audit.Record, func()) {
+	if record, ok := r.Context().Value(auditRecordKey{}).(*audit.Record); ok {
+		return record, func() {}
+	}
+
+	record := newAuditRecord(r)
+	w.Header().Set(RequestIdHeader, record.RequestId)
+	return &record, func() { i.AuditSink.Record(record) }
+}
+
+// issueCredentials checks the caller is bound to the job and gets its credentials, noting both in
+// the audit record. If it fails the error response is written and it returns false.
+func (i *credentialsIssuer) issueCredentials(w http.ResponseWriter, r *http.Request, jobId string, record *audit.Record) (*credentials.SmaugCredentials, bool) {
+	if i.AgentBinding != nil {
+		task, err := i.AgentBinding.Verify(r, jobId)
+		if task != nil {
+			record.Agent = task.AgentHostname
+		}
+		if err != nil {
+			_, record.Outcome = ErrorStatus(err)
+			writeError(err, w)
+			return nil, false
+		}
+	}
+
+	smaugCredentials, err := i.credentialsProvider.GetCredentialsForJob(jobId)
 	if err != nil {
-		writeErrorResponse(err.Error(), 500, w)
+		_, record.Outcome = ErrorStatus(err)
+		record.RoleArn = roleArnOfError(err)
+		writeError(err, w)
+		return nil, false
+	}
+
+	record.RoleArn = smaugCredentials.RoleArn
+	return smaugCredentials, true
+}
+
+// writeCredentials writes the encoded credentials, or the error encoding them, and notes the
+// outcome in the audit record.
+func writeCredentials(w http.ResponseWriter, contentType string, encoded []byte, err error, smaugCredentials *credentials.SmaugCredentials, record *audit.Record) {
+	if err != nil {
+		record.Outcome = ErrorCodeInternalError
+		writeErrorResponse(ErrorCodeInternalError, err.Error(), 500, w)
 		log.Error("Couldn't encode credentials")
 		return
 	}
 
-	w.Header().Add("Content-Type", "application/json")
-	fmt.Fprintf(w, string(encoded))
+	record.Outcome = "Success"
+	record.AccessKeyId = audit.TruncateAccessKeyId(smaugCredentials.AccessKeyID)
+	record.SessionName = smaugCredentials.SessionName
+	w.Header().Add("Content-Type", contentType)
+	w.Write(encoded)
 }
 
-func writeErrorResponse(errorMessage string, returnCode int, writer http.ResponseWriter) {
-	log.Error(errorMessage)
-	writer.WriteHeader(returnCode)
-	writer.Write([]byte(errorMessage))
+func newAuditRecord(r *http.Request) audit.Record {
+	requestId := r.Header.Get(RequestIdHeader)
+	if requestId == "" {
+		requestId = audit.NewRequestId()
+	}
+
+	return audit.Record{
+		Time:      time.Now(),
+		RequestId: requestId,
+		Caller:    r.RemoteAddr,
+	}
 }
 
 func GetJobIdFromRequest(r *http.Request) (string, error) {
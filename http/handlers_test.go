@@ -2,15 +2,21 @@ package http_test
 
 import (
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/go-errors/errors"
 	"github.com/schibsted/smaug/credentials"
 	http_pkg "github.com/schibsted/smaug/http"
+	"github.com/schibsted/smaug/role"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGetJobNameFromRequestReturnsJobNameIfUrlIsCorrect(t *testing.T) {
@@ -47,7 +53,7 @@ func TestSecurityProviderHandlerReturnsErrorIfUrlIsIncorrect(t *testing.T) {
 
 	body, _ := ioutil.ReadAll(writer.Body)
 	assert.Equal(t, 404, writer.Code)
-	assert.Equal(t, fmt.Sprintf("Couldn't get Job Id from request url: %s", testUrl), string(body))
+	assert.Equal(t, fmt.Sprintf("{\"code\":\"InvalidRequest\",\"message\":\"Couldn't get Job Id from request url: %s\"}", testUrl), string(body))
 }
 
 func TestSecurityProviderHandlerReturnNoCredentialsIfCredentialsForJobDoNotExist(t *testing.T) {
@@ -62,7 +68,7 @@ func TestSecurityProviderHandlerReturnNoCredentialsIfCredentialsForJobDoNotExist
 
 	body, _ := ioutil.ReadAll(writer.Body)
 	assert.Equal(t, 404, writer.Code)
-	assert.Equal(t, "Couldn't find credentials for job: dd9404e6-d09b-4124-85bf-98018695b05d", string(body))
+	assert.Equal(t, "{\"code\":\"UnknownJob\",\"message\":\"Couldn't find credentials for job: dd9404e6-d09b-4124-85bf-98018695b05d\"}", string(body))
 }
 
 func TestSecurityProviderHandlerReturnCredentialsValueIfCredentialsForJobExists(t *testing.T) {
@@ -84,13 +90,127 @@ func TestSecurityProviderHandlerReturnCredentialsValueIfCredentialsForJobExists(
 	assert.Equal(t, expectedResponseBody, string(body))
 }
 
+func TestSecurityProviderHandlerReturnsErrorStatusForFailure(t *testing.T) {
+	jobId := "myjob"
+	roleArn := "arn:aws:iam::111111111:myrole/role"
+
+	tests := []struct {
+		stsError     error
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			awserr.NewRequestFailure(awserr.New("AccessDenied", "Not authorized", nil), 403, "request-id"),
+			403,
+			`{"code":"AssumeRoleDenied","message":"Could not get credentials for role: arn:aws:iam::111111111:myrole/role"}`,
+		},
+		{
+			awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "request-id"),
+			429,
+			`{"code":"Throttled","message":"Could not get credentials for role: arn:aws:iam::111111111:myrole/role"}`,
+		},
+		{
+			awserr.NewRequestFailure(awserr.New("InternalFailure", "Internal failure", nil), 500, "request-id"),
+			502,
+			`{"code":"UpstreamError","message":"Could not get credentials for role: arn:aws:iam::111111111:myrole/role"}`,
+		},
+		{
+			awserr.New("RequestError", "send request failed", nil),
+			503,
+			`{"code":"UpstreamUnavailable","message":"Could not get credentials for role: arn:aws:iam::111111111:myrole/role"}`,
+		},
+		{
+			errors.Errorf("Unexpected"),
+			500,
+			`{"code":"InternalError","message":"Could not get credentials for role: arn:aws:iam::111111111:myrole/role"}`,
+		},
+	}
+
+	for _, test := range tests {
+		roleRepository := role.NewInMemoryRoleRepository()
+		roleRepository.AddRole(jobId, roleArn)
+		stub := &MockSTSClient{err: test.stsError}
+		credentialsProvider := credentials.NewDefaultCredentialsProvider(roleRepository, credentials.NewDefaultCredentialsRepository(stub))
+		handler := http_pkg.NewCredentialsProviderHandler(credentialsProvider)
+
+		req, _ := http.NewRequest("GET", "/credentials/"+jobId, nil)
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+
+		body, _ := ioutil.ReadAll(writer.Body)
+		assert.Equal(t, test.expectedCode, writer.Code)
+		assert.Equal(t, test.expectedBody, string(body))
+	}
+}
+
+func TestSecurityProviderHandlerReturnsNotFoundIfJobHasNoRole(t *testing.T) {
+	credentialsProvider := credentials.NewDefaultCredentialsProvider(role.NewInMemoryRoleRepository(), credentials.NewDefaultCredentialsRepository(&MockSTSClient{}))
+	handler := http_pkg.NewCredentialsProviderHandler(credentialsProvider)
+
+	req, _ := http.NewRequest("GET", "/credentials/myjob", nil)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	body, _ := ioutil.ReadAll(writer.Body)
+	assert.Equal(t, 404, writer.Code)
+	assert.Equal(t, `{"code":"UnknownJob","message":"Could not get role for job: myjob"}`, string(body))
+}
+
+func TestErrorStatusForRoleSourceErrors(t *testing.T) {
+	status, code := http_pkg.ErrorStatus(&credentials.JobRoleError{JobId: "myjob", Cause: &role.TaskNotRunningError{JobId: "myjob", State: "TASK_FINISHED"}})
+	assert.Equal(t, 404, status)
+	assert.Equal(t, "TaskNotRunning", code)
+
+	status, code = http_pkg.ErrorStatus(&credentials.JobRoleError{JobId: "myjob", Cause: &role.SourceUnavailableError{Source: "Mesos", Cause: errors.Errorf("Timeout")}})
+	assert.Equal(t, 503, status)
+	assert.Equal(t, "UpstreamUnavailable", code)
+}
+
+func TestSecurityProviderHandlerServesConcurrentRequests(t *testing.T) {
+	jobIds := []string{"job-a", "job-b", "job-c"}
+
+	roleRepository := role.NewInMemoryRoleRepository()
+	for _, jobId := range jobIds {
+		roleRepository.AddRole(jobId, "arn:aws:iam::111111111:myrole/"+jobId)
+	}
+
+	expiry := time.Now().Add(60 * time.Minute)
+	stub := &MockSTSClient{}
+	stub.SetCredentials(&sts.Credentials{
+		AccessKeyId:     aws.String("Key"),
+		SecretAccessKey: aws.String("Secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      &expiry,
+	})
+
+	credentialsRepository := credentials.NewDefaultCredentialsRepository(stub)
+	credentialsProvider := credentials.NewDefaultCredentialsProvider(roleRepository, credentialsRepository)
+	handler := http_pkg.NewCredentialsProviderHandler(credentialsProvider)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		jobId := jobIds[i%len(jobIds)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/credentials/"+jobId, nil)
+			writer := httptest.NewRecorder()
+			handler.ServeHTTP(writer, req)
+			assert.Equal(t, 200, writer.Code)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, len(jobIds), stub.Calls())
+}
+
 func GetCredentials(roleArn string) *credentials.SmaugCredentials {
 	creds := &credentials.SmaugCredentials{
-		"myKey",
-		"mySecret",
-		"MyToken",
-		"MyProvider",
-		"2017-04-11T21:49:00Z",
+		RoleArn:         "myKey",
+		AccessKeyID:     "mySecret",
+		SecretAccessKey: "MyToken",
+		SessionToken:    "MyProvider",
+		Expiration:      "2017-04-11T21:49:00Z",
 	}
 
 	return creds
@@ -98,13 +218,29 @@ func GetCredentials(roleArn string) *credentials.SmaugCredentials {
 
 type MockSTSClient struct {
 	stsiface.STSAPI
+	mutex sync.Mutex
 	creds *sts.Credentials
+	err   error
+	calls int
 }
 
 func (m *MockSTSClient) SetCredentials(creds *sts.Credentials) {
 	m.creds = creds
 }
+func (m *MockSTSClient) Calls() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.calls
+}
 func (m *MockSTSClient) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	m.mutex.Lock()
+	m.calls++
+	m.mutex.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+	if m.err != nil {
+		return nil, m.err
+	}
 	return &sts.AssumeRoleOutput{
 		Credentials: m.creds,
 	}, nil
@@ -0,0 +1,258 @@
+package http
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "smaug_http_rejected_requests_total",
+	Help: "Requests rejected by source or rate limits, by handler and reason.",
+}, []string{"handler", "reason"})
+
+func init() {
+	prometheus.MustRegister(rejectedRequests)
+}
+
+// Reasons of the rejected requests.
+const (
+	RejectedSource     = "source"
+	RejectedCallerRate = "caller_rate"
+	RejectedJobRate    = "job_rate"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second up to Burst tokens, at least one,
+// and every request takes a token. A zero Rate doesn't limit requests.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseCIDRs parses networks in CIDR notation, single addresses are networks of their own.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Errorf("Invalid address: %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Errorf("Invalid CIDR %s: %s", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Request Limiter
+//
+// RequestLimiter refuses the requests from denied sources, or from sources that aren't allowed if there's
+// an allow list, and limits the rate of requests per caller address and per job, so a task in a crash loop
+// can't make smaug call STS without bound. Its buckets are shared by all the handlers it limits.
+func NewRequestLimiter(options ...func(*RequestLimiter)) *RequestLimiter {
+	limiter := &RequestLimiter{
+		Now:     time.Now,
+		callers: make(map[string]*tokenBucket),
+		jobs:    make(map[string]*tokenBucket),
+	}
+
+	for _, option := range options {
+		option(limiter)
+	}
+
+	return limiter
+}
+
+type RequestLimiter struct {
+	// Allowed are the networks requests can come from, any if empty. Denied networks take precedence.
+	Allowed []*net.IPNet
+	Denied  []*net.IPNet
+
+	PerCaller RateLimit
+	PerJob    RateLimit
+
+	Now func() time.Time
+
+	mutex     sync.Mutex
+	callers   map[string]*tokenBucket
+	jobs      map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// Limit applies the limits before handler, jobId returns the job of a request or an error if it
+// has none, in which case only the limits of its caller apply.
+func (l *RequestLimiter) Limit(name string, handler http.Handler, jobId func(*http.Request) (string, error)) http.Handler {
+	return l.LimitCallers(name, l.LimitJobs(name, handler, jobId))
+}
+
+// LimitCallers refuses the requests from sources that aren't allowed and applies the limit per
+// caller before handler. It goes in front of the authentication, so unauthenticated callers can't
+// flood it.
+func (l *RequestLimiter) LimitCallers(name string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller := callerAddress(r)
+
+		if !l.sourceAllowed(net.ParseIP(caller)) {
+			log.Warnf("Rejected request to %s from %s: source not allowed", name, caller)
+			rejectedRequests.WithLabelValues(name, RejectedSource).Inc()
+			writeJSONError(ErrorCodeAccessDenied, "Source address not allowed: "+caller, 403, w)
+			return
+		}
+
+		if wait := l.take(l.callers, caller, l.PerCaller); wait > 0 {
+			l.reject(name, caller, "", RejectedCallerRate, wait, w)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// LimitJobs applies the limit per job before handler. It goes behind the authentication, so only
+// authenticated requests are charged to the job and other callers can't starve it. Requests
+// without job aren't limited.
+func (l *RequestLimiter) LimitJobs(name string, handler http.Handler, jobId func(*http.Request) (string, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if job, err := jobId(r); err == nil && job != "" {
+			if wait := l.take(l.jobs, job, l.PerJob); wait > 0 {
+				l.reject(name, callerAddress(r), job, RejectedJobRate, wait, w)
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (l *RequestLimiter) reject(name string, caller string, job string, reason string, retryAfter time.Duration, w http.ResponseWriter) {
+	log.Warnf("Rejected request to %s from %s for job %s: %s limit exceeded", name, caller, job, reason)
+	rejectedRequests.WithLabelValues(name, reason).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeJSONError(ErrorCodeRateLimited, "Too many requests, retry later", 429, w)
+}
+
+func callerAddress(r *http.Request) string {
+	caller, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return caller
+}
+
+func (l *RequestLimiter) sourceAllowed(ip net.IP) bool {
+	if ip == nil {
+		return len(l.Allowed) == 0 && len(l.Denied) == 0
+	}
+	for _, network := range l.Denied {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(l.Allowed) == 0 {
+		return true
+	}
+	for _, network := range l.Allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// take takes a token from the bucket of a key, returning how long to wait if it's empty.
+func (l *RequestLimiter) take(buckets map[string]*tokenBucket, key string, limit RateLimit) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.Now()
+	if now.Sub(l.lastPrune) >= time.Minute {
+		pruneBuckets(l.callers, l.PerCaller, now)
+		pruneBuckets(l.jobs, l.PerJob, now)
+		l.lastPrune = now
+	}
+
+	b := bucket(buckets, key, limit, now)
+	if wait := b.wait(limit); wait > 0 {
+		return wait
+	}
+	b.take()
+
+	return 0
+}
+
+// capacity returns the number of tokens of a full bucket.
+func (l RateLimit) capacity() float64 {
+	return math.Max(1, float64(l.Burst))
+}
+
+// bucket returns the bucket of a key refilled until now, nil if the requests aren't limited.
+func bucket(buckets map[string]*tokenBucket, key string, limit RateLimit, now time.Time) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	b, ok := buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: limit.capacity(), last: now}
+		buckets[key] = b
+	}
+	b.refill(limit, now)
+	return b
+}
+
+// pruneBuckets forgets the buckets that are full again.
+func pruneBuckets(buckets map[string]*tokenBucket, limit RateLimit, now time.Time) {
+	for key, b := range buckets {
+		b.refill(limit, now)
+		if b.tokens >= limit.capacity() {
+			delete(buckets, key)
+		}
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(limit.capacity(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+		b.last = now
+	}
+}
+
+// wait returns how long until the bucket has a token, zero if it has one or if there's no bucket.
+func (b *tokenBucket) wait(limit RateLimit) time.Duration {
+	if b == nil || b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take() {
+	if b != nil {
+		b.tokens--
+	}
+}
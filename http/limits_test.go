@@ -0,0 +1,128 @@
+package http_test
+
+import (
+	"encoding/json"
+	http_pkg "github.com/schibsted/smaug/http"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestLimiterFiltersSources(t *testing.T) {
+	allowed, _ := http_pkg.ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.1"})
+	denied, _ := http_pkg.ParseCIDRs([]string{"10.0.1.0/24"})
+	handler := http_pkg.NewRequestLimiter(func(l *http_pkg.RequestLimiter) {
+		l.Allowed = allowed
+		l.Denied = denied
+	}).Limit("credentials", okHandler, http_pkg.GetJobIdFromRequest)
+
+	assert.Equal(t, 200, limitedRequest(handler, "10.0.0.1:43210", "myjob").Code)
+	assert.Equal(t, 200, limitedRequest(handler, "192.168.1.1:43210", "myjob").Code)
+	assert.Equal(t, 403, limitedRequest(handler, "192.168.1.2:43210", "myjob").Code)
+
+	writer := limitedRequest(handler, "10.0.1.1:43210", "myjob")
+	assert.Equal(t, 403, writer.Code)
+	var response http_pkg.ErrorResponse
+	json.Unmarshal(writer.Body.Bytes(), &response)
+	assert.Equal(t, http_pkg.ErrorCodeAccessDenied, response.Code)
+}
+
+func TestRequestLimiterLimitsRatePerCaller(t *testing.T) {
+	now := time.Now()
+	handler := http_pkg.NewRequestLimiter(func(l *http_pkg.RequestLimiter) {
+		l.PerCaller = http_pkg.RateLimit{Rate: 0.5, Burst: 2}
+		l.Now = func() time.Time { return now }
+	}).Limit("credentials", okHandler, http_pkg.GetJobIdFromRequest)
+
+	assert.Equal(t, 200, limitedRequest(handler, "10.0.0.1:43210", "myjob").Code)
+	assert.Equal(t, 200, limitedRequest(handler, "10.0.0.1:43211", "otherjob").Code)
+
+	writer := limitedRequest(handler, "10.0.0.1:43212", "myjob")
+	assert.Equal(t, 429, writer.Code)
+	assert.Equal(t, "2", writer.Header().Get("Retry-After"))
+	var response http_pkg.ErrorResponse
+	json.Unmarshal(writer.Body.Bytes(), &response)
+	assert.Equal(t, http_pkg.ErrorCodeRateLimited, response.Code)
+
+	assert.Equal(t, 200, limitedRequest(handler, "10.0.0.2:43210", "myjob").Code)
+
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, 200, limitedRequest(handler, "10.0.0.1:43210", "myjob").Code)
+	assert.Equal(t, 429, limitedRequest(handler, "10.0.0.1:43210", "myjob").Code)
+}
+
+func TestRequestLimiterLimitsRatePerJob(t *testing.T) {
+	now := time.Now()
+	handler := http_pkg.NewRequestLimiter(func(l *http_pkg.RequestLimiter) {
+		l.PerCaller = http_pkg.RateLimit{Rate: 1, Burst: 2}
+		l.PerJob = http_pkg.RateLimit{Rate: 1, Burst: 1}
+		l.Now = func() time.Time { return now }
+	}).Limit("credentials", okHandler, http_pkg.GetJobIdFromRequest)
+
+	assert.Equal(t, 200, limitedRequest(handler, "10.0.0.1:43210", "myjob").Code)
+	writer := limitedRequest(handler, "10.0.0.2:43210", "myjob")
+	assert.Equal(t, 429, writer.Code)
+	assert.Equal(t, "1", writer.Header().Get("Retry-After"))
+
+	// The rejected request still counts against its caller.
+	assert.Equal(t, 200, limitedRequest(handler, "10.0.0.2:43210", "otherjob").Code)
+	assert.Equal(t, 429, limitedRequest(handler, "10.0.0.2:43210", "thirdjob").Code)
+}
+
+func TestRequestLimiterOnlyLimitsCallersOfRequestsWithoutJob(t *testing.T) {
+	handler := http_pkg.NewRequestLimiter(func(l *http_pkg.RequestLimiter) {
+		l.PerJob = http_pkg.RateLimit{Rate: 1, Burst: 1}
+	}).Limit("credentials", okHandler, http_pkg.GetJobIdFromRequest)
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "/credentials", nil)
+		req.RemoteAddr = "10.0.0.1:43210"
+		writer := httptest.NewRecorder()
+		handler.ServeHTTP(writer, req)
+		assert.Equal(t, 200, writer.Code)
+	}
+}
+
+func TestRequestLimiterOnlyChargesJobsWithRequestsThatGetPastAuthentication(t *testing.T) {
+	limiter := http_pkg.NewRequestLimiter(func(l *http_pkg.RequestLimiter) {
+		l.PerJob = http_pkg.RateLimit{Rate: 1, Burst: 1}
+	})
+	authenticated := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RemoteAddr != "10.0.0.1:43210" {
+			w.WriteHeader(401)
+			return
+		}
+		limiter.LimitJobs("credentials", okHandler, http_pkg.GetJobIdFromRequest).ServeHTTP(w, r)
+	})
+	handler := limiter.LimitCallers("credentials", authenticated)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 401, limitedRequest(handler, "10.0.0.2:43210", "myjob").Code)
+	}
+	assert.Equal(t, 200, limitedRequest(handler, "10.0.0.1:43210", "myjob").Code)
+	assert.Equal(t, 429, limitedRequest(handler, "10.0.0.1:43210", "myjob").Code)
+}
+
+func TestParseCIDRsRejectsInvalidNetworks(t *testing.T) {
+	networks, err := http_pkg.ParseCIDRs([]string{"", "10.0.0.1", "2001:db8::/32"})
+	assert.Nil(t, err)
+	assert.Len(t, networks, 2)
+	assert.Equal(t, "10.0.0.1/32", networks[0].String())
+
+	_, err = http_pkg.ParseCIDRs([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+
+	_, err = http_pkg.ParseCIDRs([]string{"agent-1"})
+	assert.Error(t, err)
+}
+
+func limitedRequest(handler http.Handler, remoteAddr string, jobId string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/credentials/"+jobId, nil)
+	req.RemoteAddr = remoteAddr
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	return writer
+}
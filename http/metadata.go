@@ -0,0 +1,123 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/go-errors/errors"
+	"github.com/schibsted/smaug/audit"
+	"github.com/schibsted/smaug/credentials"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	// JobIdHeader selects the job on the EC2 metadata endpoints when it isn't in the path.
+	JobIdHeader = "X-Smaug-Job-Id"
+)
+
+var (
+	// MetadataUrlRegexExpression matches /latest/meta-data/iam/security-credentials/<role-name>,
+	// optionally prefixed by /jobs/<job-id>.
+	MetadataUrlRegexExpression = "^(?:/jobs/([^/]+))?/latest/meta-data/iam/security-credentials(?:/([^/]*))?$"
+)
+
+// EC2MetadataCredentials has the layout of the EC2 instance metadata security credentials.
+type EC2MetadataCredentials struct {
+	Code            string
+	LastUpdated     string
+	Type            string
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+}
+
+// EC2MetadataHandler serves the credentials of a job like the EC2 instance metadata service does,
+// so SDKs that can only read credentials from the instance metadata can use them.
+func NewEC2MetadataHandler(provider credentials.CredentialsProvider, options ...func(*EC2MetadataHandler)) *EC2MetadataHandler {
+	handler := &EC2MetadataHandler{
+		credentialsIssuer: credentialsIssuer{credentialsProvider: provider, AuditSink: audit.NopSink{}},
+	}
+
+	for _, option := range options {
+		option(handler)
+	}
+
+	return handler
+}
+
+type EC2MetadataHandler struct {
+	credentialsIssuer
+}
+
+func (h *EC2MetadataHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	record, done := h.startAudit(w, r)
+	defer done()
+
+	jobId, roleName, err := GetMetadataRequestParams(r)
+	log.Debug("JobId: ", jobId)
+	record.JobId = jobId
+	if err != nil {
+		record.Outcome = ErrorCodeInvalidRequest
+		writeErrorResponse(ErrorCodeInvalidRequest, err.Error(), 404, w)
+		return
+	}
+
+	smaugCredentials, ok := h.issueCredentials(w, r, jobId, record)
+	if !ok {
+		return
+	}
+	jobRoleName := RoleNameFromArn(smaugCredentials.RoleArn)
+
+	if roleName == "" {
+		// Only the role name is given, so no access key is recorded.
+		record.Outcome = "Success"
+		w.Header().Add("Content-Type", "text/plain")
+		w.Write([]byte(jobRoleName))
+		return
+	}
+
+	if roleName != jobRoleName {
+		record.Outcome = ErrorCodeInvalidRequest
+		writeErrorResponse(ErrorCodeInvalidRequest, errors.Errorf("Job %s has no role %s", jobId, roleName).Error(), 404, w)
+		return
+	}
+
+	encoded, err := json.MarshalIndent(&EC2MetadataCredentials{
+		Code:            "Success",
+		LastUpdated:     smaugCredentials.LastUpdated,
+		Type:            "AWS-HMAC",
+		AccessKeyId:     smaugCredentials.AccessKeyID,
+		SecretAccessKey: smaugCredentials.SecretAccessKey,
+		Token:           smaugCredentials.SessionToken,
+		Expiration:      smaugCredentials.Expiration,
+	}, "", "  ")
+	writeCredentials(w, "text/plain", encoded, err, smaugCredentials, record)
+}
+
+// GetMetadataRequestParams returns the job and the role name requested on the EC2 metadata endpoints.
+// The job is taken from the /jobs/<job-id> path prefix or from the JobIdHeader.
+func GetMetadataRequestParams(r *http.Request) (string, string, error) {
+	UrlRegex := regexp.MustCompile(MetadataUrlRegexExpression)
+
+	match := UrlRegex.FindStringSubmatch(r.URL.EscapedPath())
+	if match == nil {
+		return "", "", errors.Errorf("Couldn't get role name from request url: %s", r.URL)
+	}
+
+	jobId := match[1]
+	if jobId == "" {
+		jobId = r.Header.Get(JobIdHeader)
+	}
+	if jobId == "" {
+		return "", "", errors.Errorf("Couldn't get Job Id from request url or %s header: %s", JobIdHeader, r.URL)
+	}
+
+	return jobId, match[2], nil
+}
+
+// RoleNameFromArn returns the name of a role without its path, as listed by the EC2 metadata.
+func RoleNameFromArn(roleArn string) string {
+	return roleArn[strings.LastIndex(roleArn, "/")+1:]
+}
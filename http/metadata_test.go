@@ -0,0 +1,126 @@
+package http_test
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/schibsted/smaug/credentials"
+	http_pkg "github.com/schibsted/smaug/http"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetMetadataRequestParamsReturnsJobIdFromPathPrefix(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/jobs/myjob/latest/meta-data/iam/security-credentials/role", nil)
+
+	jobId, roleName, err := http_pkg.GetMetadataRequestParams(req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "myjob", jobId)
+	assert.Equal(t, "role", roleName)
+}
+
+func TestGetMetadataRequestParamsReturnsJobIdFromHeader(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	req.Header.Set(http_pkg.JobIdHeader, "myjob")
+
+	jobId, roleName, err := http_pkg.GetMetadataRequestParams(req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "myjob", jobId)
+	assert.Empty(t, roleName)
+}
+
+func TestGetMetadataRequestParamsReturnsErrorWithoutJobId(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+
+	_, _, err := http_pkg.GetMetadataRequestParams(req)
+
+	assert.Error(t, err)
+}
+
+func TestEC2MetadataHandlerListsRoleNameOfJob(t *testing.T) {
+	handler := newEC2MetadataHandler("myjob")
+	req, _ := http.NewRequest("GET", "/jobs/myjob/latest/meta-data/iam/security-credentials/", nil)
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	body, _ := ioutil.ReadAll(writer.Body)
+	assert.Equal(t, 200, writer.Code)
+	assert.Equal(t, "role", string(body))
+}
+
+func TestEC2MetadataHandlerReturnsErrorForOtherRoleName(t *testing.T) {
+	handler := newEC2MetadataHandler("myjob")
+	req, _ := http.NewRequest("GET", "/jobs/myjob/latest/meta-data/iam/security-credentials/other", nil)
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	assert.Equal(t, 404, writer.Code)
+}
+
+func TestEC2MetadataHandlerReturnsCredentialsInMetadataLayout(t *testing.T) {
+	handler := newEC2MetadataHandler("myjob")
+	req, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil)
+	req.Header.Set(http_pkg.JobIdHeader, "myjob")
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	body, _ := ioutil.ReadAll(writer.Body)
+	assert.Equal(t, 200, writer.Code)
+	expectedResponseBody := `{
+  "Code": "Success",
+  "LastUpdated": "2030-04-11T20:49:00Z",
+  "Type": "AWS-HMAC",
+  "AccessKeyId": "Key",
+  "SecretAccessKey": "Secret",
+  "Token": "Token",
+  "Expiration": "2030-04-11T21:49:00Z"
+}`
+	assert.Equal(t, expectedResponseBody, string(body))
+}
+
+func TestEC2MetadataHandlerIsReadableByEC2RoleProvider(t *testing.T) {
+	server := httptest.NewServer(newEC2MetadataHandler("myjob"))
+	defer server.Close()
+
+	provider := &ec2rolecreds.EC2RoleProvider{
+		Client: ec2metadata.New(session.Must(session.NewSession()), &aws.Config{
+			Endpoint: aws.String(server.URL + "/jobs/myjob/latest"),
+		}),
+	}
+
+	value, err := provider.Retrieve()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "Key", value.AccessKeyID)
+	assert.Equal(t, "Secret", value.SecretAccessKey)
+	assert.Equal(t, "Token", value.SessionToken)
+
+	provider.CurrentTime = func() time.Time { return time.Date(2030, 4, 11, 21, 0, 0, 0, time.UTC) }
+	assert.False(t, provider.IsExpired())
+	provider.CurrentTime = func() time.Time { return time.Date(2030, 4, 11, 22, 0, 0, 0, time.UTC) }
+	assert.True(t, provider.IsExpired())
+}
+
+func newEC2MetadataHandler(jobId string) *http_pkg.EC2MetadataHandler {
+	credentialsProvider := credentials.NewInMemoryCredentialsProvider()
+	credentialsProvider.AddCredentials(jobId, &credentials.SmaugCredentials{
+		RoleArn:         "arn:aws:iam::111111111:role/path/role",
+		AccessKeyID:     "Key",
+		SecretAccessKey: "Secret",
+		SessionToken:    "Token",
+		Expiration:      "2030-04-11T21:49:00Z",
+		LastUpdated:     "2030-04-11T20:49:00Z",
+	})
+
+	return http_pkg.NewEC2MetadataHandler(credentialsProvider)
+}
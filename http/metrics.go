@@ -0,0 +1,77 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smaug_http_requests_total",
+		Help: "Credentials requests by handler and outcome.",
+	}, []string{"handler", "outcome"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "smaug_http_request_duration_seconds",
+		Help: "Latency of credentials requests.",
+	}, []string{"handler"})
+)
+
+func init() {
+	prometheus.MustRegister(requests, requestDuration)
+}
+
+// Collectors returns the metrics of the requests served by all the handlers.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{requests, requestDuration, rejectedRequests}
+}
+
+// Instrument counts the requests served by a handler by outcome, the error code of the
+// response or Success, and measures their latency.
+func Instrument(name string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w, status: 200}
+
+		handler.ServeHTTP(recorder, r)
+
+		requestDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		requests.WithLabelValues(name, recorder.outcome()).Inc()
+	})
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status    int
+	errorCode string
+	written   bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write takes the error code from the body of error responses, which are written at once.
+func (r *responseRecorder) Write(body []byte) (int, error) {
+	if !r.written && r.status >= 400 {
+		var response ErrorResponse
+		if err := json.Unmarshal(body, &response); err == nil {
+			r.errorCode = response.Code
+		}
+	}
+	r.written = true
+	return r.ResponseWriter.Write(body)
+}
+
+func (r *responseRecorder) outcome() string {
+	if r.errorCode != "" {
+		return r.errorCode
+	}
+	if r.status < 400 {
+		return "Success"
+	}
+	return strconv.Itoa(r.status)
+}
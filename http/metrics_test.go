@@ -0,0 +1,31 @@
+package http_test
+
+import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/schibsted/smaug/credentials"
+	http_pkg "github.com/schibsted/smaug/http"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInstrumentCountsRequestsByOutcome(t *testing.T) {
+	credentialsProvider := credentials.NewInMemoryCredentialsProvider()
+	credentialsProvider.AddCredentials("myjob", GetCredentials("arn:aws:iam::111111111:myrole/role"))
+	handler := http_pkg.Instrument("test", http_pkg.NewCredentialsProviderHandler(credentialsProvider))
+
+	for _, url := range []string{"/credentials/myjob", "/credentials/myjob", "/credentials/otherjob", "/credentials"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	writer := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(writer, req)
+
+	assert.Contains(t, writer.Body.String(), `smaug_http_requests_total{handler="test",outcome="Success"} 2`)
+	assert.Contains(t, writer.Body.String(), `smaug_http_requests_total{handler="test",outcome="UnknownJob"} 1`)
+	assert.Contains(t, writer.Body.String(), `smaug_http_requests_total{handler="test",outcome="InvalidRequest"} 1`)
+	assert.Contains(t, writer.Body.String(), `smaug_http_request_duration_seconds_count{handler="test"} 4`)
+}
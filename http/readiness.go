@@ -0,0 +1,192 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/schibsted/smaug/credentials"
+	"github.com/schibsted/smaug/role"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultProbeInterval is how long readiness trusts the last successful STS call before probing again.
+	DefaultProbeInterval = 1 * time.Minute
+)
+
+// RolesStatus is implemented by role repositories that know how their last load went.
+type RolesStatus interface {
+	Status() role.LoadStatus
+}
+
+// TasksStatus is implemented by the sources of running tasks, like MesosRoleRepository, that know
+// whether their snapshot of the tasks can be trusted.
+type TasksStatus interface {
+	Status() role.LoadStatus
+	Healthy() bool
+}
+
+// CredentialsStatus is implemented by credentials repositories that call STS.
+type CredentialsStatus interface {
+	Stats() credentials.CacheStats
+	StsStatus() credentials.StsStatus
+	Probe() error
+}
+
+// Readiness is the body of the readiness response.
+type Readiness struct {
+	Ready bool            `json:"ready"`
+	Roles *RolesReadiness `json:"roles,omitempty"`
+	Tasks *RolesReadiness `json:"tasks,omitempty"`
+	Sts   StsReadiness    `json:"sts"`
+	Cache CacheReadiness  `json:"cache"`
+}
+
+type RolesReadiness struct {
+	Ok          bool       `json:"ok"`
+	Jobs        int        `json:"jobs"`
+	LastLoad    *time.Time `json:"last_load,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type StsReadiness struct {
+	Ok          bool       `json:"ok"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type CacheReadiness struct {
+	CachedRoles       int        `json:"cached_roles"`
+	SoonestExpiration *time.Time `json:"soonest_expiration,omitempty"`
+}
+
+// ReadinessHandler answers 200 when smaug can issue credentials and 503 when it can't, because
+// the roles were never loaded, the running tasks aren't known or the last call to STS failed recently. A failed reload of the roles is
+// reported but doesn't make smaug unready, as the last good mapping keeps being served.
+func NewReadinessHandler(roles RolesStatus, credentialsStatus CredentialsStatus, options ...func(*ReadinessHandler)) *ReadinessHandler {
+	handler := &ReadinessHandler{
+		roles:         roles,
+		credentials:   credentialsStatus,
+		ProbeInterval: DefaultProbeInterval,
+	}
+
+	for _, option := range options {
+		option(handler)
+	}
+
+	return handler
+}
+
+type ReadinessHandler struct {
+	roles       RolesStatus
+	credentials CredentialsStatus
+
+	// Tasks is the source of the running tasks, if roles are only given to running tasks.
+	Tasks TasksStatus
+
+	// Probe calls STS GetCallerIdentity when there was no successful STS call in the last ProbeInterval.
+	Probe         bool
+	ProbeInterval time.Duration
+
+	probeMutex sync.Mutex
+}
+
+func (h *ReadinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	readiness := h.Readiness()
+
+	encoded, err := json.Marshal(&readiness)
+	if err != nil {
+		writeErrorResponse(ErrorCodeInternalError, err.Error(), 500, w)
+		log.Error("Couldn't encode readiness")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if !readiness.Ready {
+		w.WriteHeader(503)
+	}
+	w.Write(encoded)
+}
+
+func (h *ReadinessHandler) Readiness() Readiness {
+	if h.Probe {
+		h.probe()
+	}
+
+	readiness := Readiness{Ready: true}
+
+	if h.roles != nil {
+		status := h.roles.Status()
+		readiness.Roles = &RolesReadiness{
+			Ok:          status.LastError == nil,
+			Jobs:        status.Jobs,
+			LastLoad:    optionalTime(status.LastLoad),
+			LastSuccess: optionalTime(status.LastSuccess),
+		}
+		if status.LastError != nil {
+			readiness.Roles.Error = status.LastError.Error()
+		}
+		if status.LastSuccess.IsZero() {
+			readiness.Ready = false
+		}
+	}
+
+	if h.Tasks != nil {
+		status := h.Tasks.Status()
+		readiness.Tasks = &RolesReadiness{
+			Ok:          h.Tasks.Healthy(),
+			Jobs:        status.Jobs,
+			LastLoad:    optionalTime(status.LastLoad),
+			LastSuccess: optionalTime(status.LastSuccess),
+		}
+		if status.LastError != nil {
+			readiness.Tasks.Error = status.LastError.Error()
+		}
+		if !readiness.Tasks.Ok {
+			readiness.Ready = false
+		}
+	}
+
+	stsStatus := h.credentials.StsStatus()
+	readiness.Sts = StsReadiness{
+		Ok:          stsStatus.Healthy(),
+		LastSuccess: optionalTime(stsStatus.LastSuccess),
+		LastFailure: optionalTime(stsStatus.LastFailure),
+	}
+	if !stsStatus.Healthy() {
+		readiness.Sts.Error = stsStatus.LastError.Error()
+		readiness.Ready = false
+	}
+
+	stats := h.credentials.Stats()
+	readiness.Cache = CacheReadiness{
+		CachedRoles:       stats.CachedRoles,
+		SoonestExpiration: optionalTime(stats.SoonestExpiration),
+	}
+
+	return readiness
+}
+
+// probe calls STS unless it already succeeded recently, only one probe runs at a time.
+func (h *ReadinessHandler) probe() {
+	h.probeMutex.Lock()
+	defer h.probeMutex.Unlock()
+
+	if time.Since(h.credentials.StsStatus().LastSuccess) < h.ProbeInterval {
+		return
+	}
+	if err := h.credentials.Probe(); err != nil {
+		log.Error("STS probe failed: ", err)
+	}
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
@@ -0,0 +1,163 @@
+package http_test
+
+import (
+	"encoding/json"
+	"github.com/go-errors/errors"
+	"github.com/schibsted/smaug/credentials"
+	http_pkg "github.com/schibsted/smaug/http"
+	"github.com/schibsted/smaug/role"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadinessHandlerReturnsReadyStatus(t *testing.T) {
+	loaded := time.Date(2030, 4, 11, 21, 0, 0, 0, time.UTC)
+	expiration := time.Date(2030, 4, 11, 21, 49, 0, 0, time.UTC)
+	roles := &mockRolesStatus{role.LoadStatus{Jobs: 3, LastLoad: loaded, LastSuccess: loaded}}
+	creds := &mockCredentialsStatus{
+		stats:     credentials.CacheStats{CachedRoles: 2, SoonestExpiration: expiration},
+		stsStatus: credentials.StsStatus{LastSuccess: loaded},
+	}
+	handler := http_pkg.NewReadinessHandler(roles, creds)
+
+	req, _ := http.NewRequest("GET", "/ready", nil)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	assert.Equal(t, 200, writer.Code)
+	expected := `{"ready":true,"roles":{"ok":true,"jobs":3,"last_load":"2030-04-11T21:00:00Z","last_success":"2030-04-11T21:00:00Z"},"sts":{"ok":true,"last_success":"2030-04-11T21:00:00Z"},"cache":{"cached_roles":2,"soonest_expiration":"2030-04-11T21:49:00Z"}}`
+	assert.Equal(t, expected, writer.Body.String())
+	assert.Equal(t, 0, creds.probes)
+}
+
+func TestReadinessHandlerIsReadyIfRolesReloadFailed(t *testing.T) {
+	loaded := time.Date(2030, 4, 11, 21, 0, 0, 0, time.UTC)
+	roles := &mockRolesStatus{role.LoadStatus{Jobs: 3, LastLoad: loaded.Add(time.Minute), LastSuccess: loaded, LastError: errors.Errorf("unclosed section")}}
+	handler := http_pkg.NewReadinessHandler(roles, &mockCredentialsStatus{})
+
+	readiness := handler.Readiness()
+
+	assert.True(t, readiness.Ready)
+	assert.False(t, readiness.Roles.Ok)
+	assert.Equal(t, "unclosed section", readiness.Roles.Error)
+}
+
+func TestReadinessHandlerReturnsUnavailableIfStsIsFailing(t *testing.T) {
+	loaded := time.Now()
+	roles := &mockRolesStatus{role.LoadStatus{Jobs: 3, LastLoad: loaded, LastSuccess: loaded}}
+	creds := &mockCredentialsStatus{
+		stsStatus: credentials.StsStatus{LastSuccess: loaded, LastFailure: loaded.Add(time.Second), LastError: errors.Errorf("send request failed")},
+	}
+	handler := http_pkg.NewReadinessHandler(roles, creds)
+
+	req, _ := http.NewRequest("GET", "/ready", nil)
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+
+	var readiness http_pkg.Readiness
+	json.Unmarshal(writer.Body.Bytes(), &readiness)
+
+	assert.Equal(t, 503, writer.Code)
+	assert.False(t, readiness.Ready)
+	assert.False(t, readiness.Sts.Ok)
+	assert.Equal(t, "send request failed", readiness.Sts.Error)
+}
+
+func TestReadinessHandlerIsReadyAgainAfterOldStsFailure(t *testing.T) {
+	failed := time.Now().Add(-2 * credentials.StsFailureWindow)
+	creds := &mockCredentialsStatus{
+		stsStatus: credentials.StsStatus{LastSuccess: failed.Add(-time.Second), LastFailure: failed, LastError: errors.Errorf("send request failed")},
+	}
+	handler := http_pkg.NewReadinessHandler(nil, creds)
+
+	readiness := handler.Readiness()
+
+	assert.True(t, readiness.Ready)
+	assert.True(t, readiness.Sts.Ok)
+}
+
+func TestReadinessHandlerProbesStsWithoutRecentSuccess(t *testing.T) {
+	creds := &mockCredentialsStatus{probeError: errors.Errorf("send request failed")}
+	handler := http_pkg.NewReadinessHandler(nil, creds, func(h *http_pkg.ReadinessHandler) {
+		h.Probe = true
+	})
+
+	readiness := handler.Readiness()
+
+	assert.False(t, readiness.Ready)
+	assert.Equal(t, 1, creds.probes)
+
+	creds.probeError = nil
+	readiness = handler.Readiness()
+	readiness = handler.Readiness()
+
+	assert.True(t, readiness.Ready)
+	assert.Equal(t, 2, creds.probes)
+}
+
+func TestReadinessHandlerReturnsUnavailableIfTasksAreUnknown(t *testing.T) {
+	loaded := time.Now()
+	tasks := &mockTasksStatus{mockRolesStatus{role.LoadStatus{Jobs: 3, LastLoad: loaded, LastSuccess: loaded.Add(-time.Hour), LastError: errors.Errorf("connection refused")}}, false}
+	handler := http_pkg.NewReadinessHandler(nil, &mockCredentialsStatus{}, func(h *http_pkg.ReadinessHandler) {
+		h.Tasks = tasks
+	})
+
+	readiness := handler.Readiness()
+
+	assert.False(t, readiness.Ready)
+	assert.False(t, readiness.Tasks.Ok)
+	assert.Equal(t, "connection refused", readiness.Tasks.Error)
+
+	tasks.healthy = true
+	readiness = handler.Readiness()
+
+	assert.True(t, readiness.Ready)
+	assert.True(t, readiness.Tasks.Ok)
+	assert.Equal(t, 3, readiness.Tasks.Jobs)
+}
+
+type mockRolesStatus struct {
+	status role.LoadStatus
+}
+
+func (m *mockRolesStatus) Status() role.LoadStatus {
+	return m.status
+}
+
+type mockTasksStatus struct {
+	mockRolesStatus
+	healthy bool
+}
+
+func (m *mockTasksStatus) Healthy() bool {
+	return m.healthy
+}
+
+type mockCredentialsStatus struct {
+	stats      credentials.CacheStats
+	stsStatus  credentials.StsStatus
+	probeError error
+	probes     int
+}
+
+func (m *mockCredentialsStatus) Stats() credentials.CacheStats {
+	return m.stats
+}
+
+func (m *mockCredentialsStatus) StsStatus() credentials.StsStatus {
+	return m.stsStatus
+}
+
+func (m *mockCredentialsStatus) Probe() error {
+	m.probes++
+	if m.probeError != nil {
+		m.stsStatus.LastFailure = time.Now()
+		m.stsStatus.LastError = m.probeError
+		return m.probeError
+	}
+	m.stsStatus.LastSuccess = time.Now()
+	return nil
+}
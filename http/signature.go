@@ -0,0 +1,124 @@
+package http
+
+import (
+	"crypto/hmac"
+	"github.com/schibsted/smaug/client"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultMaxClockSkew is how far the timestamp of a signed request can be from the time of smaug.
+const DefaultMaxClockSkew = 5 * time.Minute
+
+// Signed Request Handler
+//
+// SignedRequestHandler only lets through the requests signed with one of the keys, as done by
+// client.Signer, whose timestamp is within MaxClockSkew and whose nonce wasn't seen before. Several
+// keys can be active at once, so they can be rotated. Requests without a signature are handed to the
+// Unsigned handler if there's one, like a ClientCertificateHandler for callers with certificates.
+func NewSignedRequestHandler(handler http.Handler, keys map[string][]byte, options ...func(*SignedRequestHandler)) *SignedRequestHandler {
+	signed := &SignedRequestHandler{
+		handler:      handler,
+		keys:         keys,
+		MaxClockSkew: DefaultMaxClockSkew,
+		Now:          time.Now,
+		nonces:       make(map[string]time.Time),
+	}
+
+	for _, option := range options {
+		option(signed)
+	}
+
+	return signed
+}
+
+type SignedRequestHandler struct {
+	handler http.Handler
+	keys    map[string][]byte
+
+	// MaxClockSkew is how far the timestamps can be from Now.
+	MaxClockSkew time.Duration
+
+	// Unsigned serves the requests without signature, they're refused if it's nil.
+	Unsigned http.Handler
+
+	Now func() time.Time
+
+	mutex     sync.Mutex
+	nonces    map[string]time.Time
+	lastPrune time.Time
+}
+
+func (h *SignedRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	keyId := r.Header.Get(client.KeyIdHeader)
+	signature := r.Header.Get(client.SignatureHeader)
+	if keyId == "" && signature == "" && h.Unsigned != nil {
+		h.Unsigned.ServeHTTP(w, r)
+		return
+	}
+
+	timestamp := r.Header.Get(client.TimestampHeader)
+	nonce := r.Header.Get(client.NonceHeader)
+	if keyId == "" || signature == "" || timestamp == "" || nonce == "" {
+		writeErrorResponse(ErrorCodeUnauthorized, "A signed request is required", 401, w)
+		return
+	}
+
+	key, ok := h.keys[keyId]
+	if !ok {
+		writeErrorResponse(ErrorCodeAccessDenied, "Unknown signing key: "+keyId, 403, w)
+		return
+	}
+
+	expected := client.Signature(key, r.Method, r.URL.EscapedPath(), keyId, timestamp, nonce)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		log.Warnf("Invalid signature with key %s from %s", keyId, r.RemoteAddr)
+		writeErrorResponse(ErrorCodeAccessDenied, "Invalid signature", 403, w)
+		return
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		writeErrorResponse(ErrorCodeAccessDenied, "Invalid timestamp: "+timestamp, 403, w)
+		return
+	}
+	signedAt := time.Unix(seconds, 0)
+	now := h.Now()
+	if signedAt.Before(now.Add(-h.MaxClockSkew)) || signedAt.After(now.Add(h.MaxClockSkew)) {
+		writeErrorResponse(ErrorCodeAccessDenied, "Request timestamp is outside of the allowed clock skew", 403, w)
+		return
+	}
+
+	if !h.useNonce(keyId+"/"+nonce, signedAt.Add(h.MaxClockSkew), now) {
+		log.Warnf("Replayed nonce with key %s from %s", keyId, r.RemoteAddr)
+		writeErrorResponse(ErrorCodeAccessDenied, "Replayed request", 403, w)
+		return
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
+
+// useNonce remembers a nonce until it expires, returning false if it was already used. Nonces only
+// need to be remembered while the timestamp they were signed with is accepted.
+func (h *SignedRequestHandler) useNonce(nonce string, expiration time.Time, now time.Time) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if now.Sub(h.lastPrune) > time.Second {
+		for seen, seenExpiration := range h.nonces {
+			if now.After(seenExpiration) {
+				delete(h.nonces, seen)
+			}
+		}
+		h.lastPrune = now
+	}
+
+	if _, seen := h.nonces[nonce]; seen {
+		return false
+	}
+	h.nonces[nonce] = expiration
+	return true
+}
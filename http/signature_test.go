@@ -0,0 +1,83 @@
+package http_test
+
+import (
+	"github.com/schibsted/smaug/client"
+	http_pkg "github.com/schibsted/smaug/http"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var signingKeys = map[string][]byte{"2017-01": []byte("old key"), "2017-02": []byte("new key")}
+
+func TestSignedRequestHandlerAcceptsRequestsSignedWithAnyKey(t *testing.T) {
+	handler := http_pkg.NewSignedRequestHandler(okHandler, signingKeys)
+
+	assert.Equal(t, 200, serveSigned(handler, signedRequest(t, "2017-01", "old key")).Code)
+	assert.Equal(t, 200, serveSigned(handler, signedRequest(t, "2017-02", "new key")).Code)
+}
+
+func TestSignedRequestHandlerRefusesInvalidSignatures(t *testing.T) {
+	handler := http_pkg.NewSignedRequestHandler(okHandler, signingKeys)
+
+	assert.Equal(t, 403, serveSigned(handler, signedRequest(t, "2017-03", "new key")).Code)
+	assert.Equal(t, 403, serveSigned(handler, signedRequest(t, "2017-02", "old key")).Code)
+
+	req := signedRequest(t, "2017-02", "new key")
+	req.URL.Path = "/credentials/otherjob"
+	assert.Equal(t, 403, serveSigned(handler, req).Code)
+
+	req = signedRequest(t, "2017-02", "new key")
+	req.Method = "POST"
+	assert.Equal(t, 403, serveSigned(handler, req).Code)
+}
+
+func TestSignedRequestHandlerRefusesRequestsOutsideOfClockSkew(t *testing.T) {
+	handler := http_pkg.NewSignedRequestHandler(okHandler, signingKeys, func(h *http_pkg.SignedRequestHandler) {
+		h.MaxClockSkew = time.Minute
+		h.Now = func() time.Time {
+			return time.Now().Add(2 * time.Minute)
+		}
+	})
+
+	assert.Equal(t, 403, serveSigned(handler, signedRequest(t, "2017-02", "new key")).Code)
+}
+
+func TestSignedRequestHandlerRefusesReplayedRequests(t *testing.T) {
+	handler := http_pkg.NewSignedRequestHandler(okHandler, signingKeys)
+	req := signedRequest(t, "2017-02", "new key")
+
+	assert.Equal(t, 200, serveSigned(handler, req).Code)
+	assert.Equal(t, 403, serveSigned(handler, req).Code)
+}
+
+func TestSignedRequestHandlerHandsUnsignedRequestsToUnsignedHandler(t *testing.T) {
+	unsigned := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+	handler := http_pkg.NewSignedRequestHandler(okHandler, signingKeys)
+	withUnsigned := http_pkg.NewSignedRequestHandler(okHandler, signingKeys, func(h *http_pkg.SignedRequestHandler) {
+		h.Unsigned = unsigned
+	})
+	req, _ := http.NewRequest("GET", "/credentials/myjob", nil)
+
+	assert.Equal(t, 401, serveSigned(handler, req).Code)
+	assert.Equal(t, 204, serveSigned(withUnsigned, req).Code)
+	assert.Equal(t, 200, serveSigned(withUnsigned, signedRequest(t, "2017-02", "new key")).Code)
+}
+
+func signedRequest(t *testing.T, keyId string, key string) *http.Request {
+	req, _ := http.NewRequest("GET", "/credentials/myjob", nil)
+	if err := client.NewSigner(keyId, []byte(key)).Sign(req); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func serveSigned(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	return writer
+}
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"crypto/x509"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// Client Certificate Handler
+//
+// ClientCertificateHandler only lets through the requests made with a client certificate verified
+// by the TLS server, whose subject is allowed. Subjects are allowed by common name or by their full
+// distinguished name, like "CN=agent,O=Example", and any verified certificate is allowed if no
+// subject is.
+func NewClientCertificateHandler(handler http.Handler, allowedSubjects []string) *ClientCertificateHandler {
+	allowed := make(map[string]bool, len(allowedSubjects))
+	for _, subject := range allowedSubjects {
+		allowed[subject] = true
+	}
+
+	return &ClientCertificateHandler{handler, allowed}
+}
+
+type ClientCertificateHandler struct {
+	handler         http.Handler
+	allowedSubjects map[string]bool
+}
+
+func (h *ClientCertificateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		writeErrorResponse(ErrorCodeUnauthorized, "A client certificate is required", 401, w)
+		return
+	}
+
+	certificate := r.TLS.VerifiedChains[0][0]
+	if !h.allowed(certificate) {
+		log.Warnf("Rejected client certificate %s from %s", certificate.Subject, r.RemoteAddr)
+		writeErrorResponse(ErrorCodeAccessDenied, "Client certificate not allowed: "+certificate.Subject.String(), 403, w)
+		return
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
+
+func (h *ClientCertificateHandler) allowed(certificate *x509.Certificate) bool {
+	if len(h.allowedSubjects) == 0 {
+		return true
+	}
+	return h.allowedSubjects[certificate.Subject.CommonName] || h.allowedSubjects[certificate.Subject.String()]
+}
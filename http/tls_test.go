@@ -0,0 +1,63 @@
+package http_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	http_pkg "github.com/schibsted/smaug/http"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientCertificateHandlerRequiresVerifiedCertificate(t *testing.T) {
+	handler := http_pkg.NewClientCertificateHandler(okHandler, []string{"agent"})
+
+	assert.Equal(t, 401, serveWithCertificate(handler, nil).Code)
+
+	req, _ := http.NewRequest("GET", "/credentials/myjob", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificateFor("agent", "")}}
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	assert.Equal(t, 401, writer.Code)
+}
+
+func TestClientCertificateHandlerAllowsSubjectsByCommonNameOrDistinguishedName(t *testing.T) {
+	handler := http_pkg.NewClientCertificateHandler(okHandler, []string{"agent", "CN=other,O=Example"})
+
+	assert.Equal(t, 200, serveWithCertificate(handler, certificateFor("agent", "Anything")).Code)
+	assert.Equal(t, 200, serveWithCertificate(handler, certificateFor("other", "Example")).Code)
+	assert.Equal(t, 403, serveWithCertificate(handler, certificateFor("other", "Elsewhere")).Code)
+	assert.Equal(t, 403, serveWithCertificate(handler, certificateFor("intruder", "")).Code)
+}
+
+func TestClientCertificateHandlerAllowsAnyVerifiedCertificateWithoutSubjects(t *testing.T) {
+	handler := http_pkg.NewClientCertificateHandler(okHandler, nil)
+
+	assert.Equal(t, 200, serveWithCertificate(handler, certificateFor("anyone", "")).Code)
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func certificateFor(commonName string, organization string) *x509.Certificate {
+	subject := pkix.Name{CommonName: commonName}
+	if organization != "" {
+		subject.Organization = []string{organization}
+	}
+	return &x509.Certificate{Subject: subject}
+}
+
+func serveWithCertificate(handler http.Handler, certificate *x509.Certificate) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/credentials/myjob", nil)
+	if certificate != nil {
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{certificate},
+			VerifiedChains:   [][]*x509.Certificate{{certificate}},
+		}
+	}
+
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, req)
+	return writer
+}
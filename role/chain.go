@@ -0,0 +1,71 @@
+package role
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// ChainSource is a role repository in a chain, named in the logs.
+type ChainSource struct {
+	Name       string
+	Repository RoleRepository
+}
+
+// Chain Role Repository
+//
+// ChainRoleRepository asks its sources for the role of a job in order, until one knows the job. A source
+// that doesn't know the job makes the chain go on with the next one, while any other error is returned
+// right away, so an unreachable source or a job rejected by a source never falls back to another role.
+// Jobs no source knows get the role of Default if they match it.
+func NewChainRoleRepository(sources []ChainSource, options ...func(*ChainRoleRepository)) *ChainRoleRepository {
+	chain := &ChainRoleRepository{sources: sources}
+
+	for _, option := range options {
+		option(chain)
+	}
+
+	return chain
+}
+
+type ChainRoleRepository struct {
+	sources []ChainSource
+
+	// Default is the role given to the jobs matching it that no source knows, nil for none.
+	Default *Pattern
+}
+
+func (r *ChainRoleRepository) FindRoleByJobId(jobId string) (*Role, error) {
+	return r.find(jobId, func(repository RoleRepository) (*Role, error) {
+		return repository.FindRoleByJobId(jobId)
+	})
+}
+
+// FindRoleByTask hands the task to the sources that can use it, and its id to the others.
+func (r *ChainRoleRepository) FindRoleByTask(task *Task) (*Role, error) {
+	return r.find(task.Id, func(repository RoleRepository) (*Role, error) {
+		if taskRepository, ok := repository.(TaskRoleRepository); ok {
+			return taskRepository.FindRoleByTask(task)
+		}
+		return repository.FindRoleByJobId(task.Id)
+	})
+}
+
+func (r *ChainRoleRepository) find(jobId string, findRole func(RoleRepository) (*Role, error)) (*Role, error) {
+	for _, source := range r.sources {
+		role, err := findRole(source.Repository)
+		if err == nil {
+			log.Infof("Role for job %s found in %s: %s", jobId, source.Name, role)
+			return role, nil
+		}
+		if _, ok := err.(*UnknownJobError); !ok {
+			log.Errorf("Could not get role for job %s from %s: %s", jobId, source.Name, err)
+			return nil, err
+		}
+	}
+
+	if r.Default != nil && r.Default.Match(jobId) {
+		log.Infof("Role for job %s is the default role: %s", jobId, r.Default.Role)
+		return r.Default.Role, nil
+	}
+
+	return nil, &UnknownJobError{jobId}
+}
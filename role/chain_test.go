@@ -0,0 +1,77 @@
+package role
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestChainRoleRepository_AsksSourcesInOrder(t *testing.T) {
+	first := NewInMemoryRoleRepository()
+	first.AddRole("myjob", "arn:aws:iam::111111111:myrole/first")
+	second := NewInMemoryRoleRepository()
+	second.AddRole("myjob", "arn:aws:iam::111111111:myrole/second")
+	second.AddRole("otherjob", "arn:aws:iam::111111111:myrole/other")
+
+	chain := NewChainRoleRepository([]ChainSource{{"first", first}, {"second", second}})
+
+	role, err := chain.FindRoleByJobId("myjob")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/first"), role)
+
+	role, err = chain.FindRoleByJobId("otherjob")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/other"), role)
+
+	_, err = chain.FindRoleByJobId("unknownjob")
+	assert.Equal(t, &UnknownJobError{"unknownjob"}, err)
+}
+
+func TestChainRoleRepository_StopsOnHardErrors(t *testing.T) {
+	fallback := NewInMemoryRoleRepository()
+	fallback.AddRole("myjob", "arn:aws:iam::111111111:myrole/fallback")
+	unavailable := &SourceUnavailableError{"Marathon", errors.Errorf("Timeout")}
+
+	chain := NewChainRoleRepository([]ChainSource{{"failing", failingRoleRepository{unavailable}}, {"fallback", fallback}}, func(r *ChainRoleRepository) {
+		r.Default = mustGlob(t, "*", "arn:aws:iam::111111111:myrole/default")
+	})
+
+	_, err := chain.FindRoleByJobId("myjob")
+	assert.Equal(t, unavailable, err)
+}
+
+func TestChainRoleRepository_GivesDefaultRoleToMatchingJobs(t *testing.T) {
+	chain := NewChainRoleRepository([]ChainSource{{"empty", NewInMemoryRoleRepository()}}, func(r *ChainRoleRepository) {
+		r.Default = mustGlob(t, "sandbox_*", "arn:aws:iam::111111111:myrole/default")
+	})
+
+	role, err := chain.FindRoleByJobId("sandbox_app.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/default"), role)
+
+	_, err = chain.FindRoleByJobId("team_app.1234")
+	assert.IsType(t, &UnknownJobError{}, err)
+}
+
+func TestChainRoleRepository_HandsTaskToSourcesUsingIt(t *testing.T) {
+	byId := NewInMemoryRoleRepository()
+	byId.AddRole("team_web.1234", "arn:aws:iam::111111111:myrole/web")
+
+	chain := NewChainRoleRepository([]ChainSource{{"ids", byId}, {"labels", NewTaskLabelRoleRepository("SMAUG_ROLE")}})
+
+	role, err := chain.FindRoleByTask(&Task{Id: "team_app.1234", Labels: map[string]string{"SMAUG_ROLE": "arn:aws:iam::111111111:myrole/label"}})
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/label"), role)
+
+	role, err = chain.FindRoleByTask(&Task{Id: "team_web.1234"})
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/web"), role)
+}
+
+type failingRoleRepository struct {
+	err error
+}
+
+func (r failingRoleRepository) FindRoleByJobId(jobId string) (*Role, error) {
+	return nil, r.err
+}
@@ -0,0 +1,52 @@
+package role
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnknownJobError is returned when there's no role for a job.
+type UnknownJobError struct {
+	JobId string
+}
+
+func (e *UnknownJobError) Error() string {
+	return fmt.Sprintf("Role for job %s do not exist", e.JobId)
+}
+
+// ConflictingRulesError is returned when the roles of a job can't be told apart by precedence.
+type ConflictingRulesError struct {
+	Conflicts []string
+}
+
+func (e *ConflictingRulesError) Error() string {
+	return fmt.Sprintf("Conflicting role mappings: %s", strings.Join(e.Conflicts, "; "))
+}
+
+// TaskNotRunningError is returned when a job isn't a running task according to Mesos.
+type TaskNotRunningError struct {
+	JobId string
+	// State is the last state of the task, empty if Mesos doesn't know the task.
+	State string
+}
+
+func (e *TaskNotRunningError) Error() string {
+	if e.State == "" {
+		return fmt.Sprintf("Task %s does not exist", e.JobId)
+	}
+	return fmt.Sprintf("Task %s is not running: %s", e.JobId, e.State)
+}
+
+// SourceUnavailableError is returned when roles can't be resolved because the service they come from can't be reached.
+type SourceUnavailableError struct {
+	Source string
+	Cause  error
+}
+
+func (e *SourceUnavailableError) Error() string {
+	return fmt.Sprintf("Could not get roles from %s", e.Source)
+}
+
+func (e *SourceUnavailableError) Unwrap() error {
+	return e.Cause
+}
@@ -0,0 +1,314 @@
+package role
+
+import (
+	"fmt"
+	"github.com/go-errors/errors"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+const (
+	GlobPattern   = "glob"
+	RegexpPattern = "regexp"
+)
+
+// Mapping maps jobs to roles by their exact id or by glob and regexp patterns matching the whole id.
+// An exact id takes precedence over patterns, and the longest matching pattern over shorter ones.
+// Globs of the same length mapping to different roles are rejected if they match the same job. Patterns
+// with a regexp can't always be told apart, those that may match the same job are logged and tried in
+// the order of their String().
+func NewMapping(roles map[string]*Role, patterns []*Pattern) (*Mapping, error) {
+	sorted, conflicts := sortPatterns(patterns)
+	if len(conflicts) > 0 {
+		return nil, &ConflictingRulesError{conflicts}
+	}
+
+	if roles == nil {
+		roles = make(map[string]*Role)
+	}
+	return &Mapping{roles: roles, patterns: sorted}, nil
+}
+
+type Mapping struct {
+	roles    map[string]*Role
+	patterns []*Pattern
+	// taskNames match the framework name and the name of tasks, as framework/name.
+	taskNames []*Pattern
+	// policyFiles are the session policy files the mapping was read with.
+	policyFiles []string
+}
+
+func (m *Mapping) FindRole(jobId string) (*Role, bool) {
+	if role, ok := m.roles[jobId]; ok {
+		return role, true
+	}
+
+	for _, pattern := range m.patterns {
+		if pattern.Match(jobId) {
+			return pattern.Role, true
+		}
+	}
+
+	return nil, false
+}
+
+// FindRoleForTask looks for the role of the task id like FindRole, and then for the role of the
+// framework and name of the task.
+func (m *Mapping) FindRoleForTask(task *Task) (*Role, bool) {
+	if role, ok := m.FindRole(task.Id); ok {
+		return role, true
+	}
+
+	name := task.FrameworkName + "/" + task.Name
+	for _, pattern := range m.taskNames {
+		if pattern.Match(name) {
+			return pattern.Role, true
+		}
+	}
+
+	return nil, false
+}
+
+// Rules describes the role of every rule, keyed by job id for exact rules and by kind:expression for patterns.
+func (m *Mapping) Rules() map[string]string {
+	rules := make(map[string]string, len(m.roles)+len(m.patterns))
+	for jobId, role := range m.roles {
+		rules[jobId] = role.String()
+	}
+	for _, pattern := range m.patterns {
+		rules[pattern.String()] = pattern.Role.String()
+	}
+	for _, pattern := range m.taskNames {
+		rules["task-name:"+pattern.String()] = pattern.Role.String()
+	}
+	return rules
+}
+
+func (m *Mapping) Len() int {
+	return len(m.roles) + len(m.patterns) + len(m.taskNames)
+}
+
+// sortPatterns sorts patterns by precedence and returns the ones that can't be told apart.
+func sortPatterns(patterns []*Pattern) ([]*Pattern, []string) {
+	sorted := append([]*Pattern(nil), patterns...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if len(sorted[i].Expression) != len(sorted[j].Expression) {
+			return len(sorted[i].Expression) > len(sorted[j].Expression)
+		}
+		return sorted[i].String() < sorted[j].String()
+	})
+
+	var conflicts []string
+	for i, pattern := range sorted {
+		for _, other := range sorted[i+1:] {
+			if len(other.Expression) != len(pattern.Expression) {
+				break
+			}
+			if *other.Role == *pattern.Role || !pattern.mayOverlap(other) {
+				continue
+			}
+			if pattern.glob != nil && other.glob != nil {
+				conflicts = append(conflicts, fmt.Sprintf("%s and %s match the same jobs but map them to different roles", pattern, other))
+			} else {
+				log.Warnf("%s and %s may match the same jobs but map them to different roles, %s is tried first", pattern, other, pattern)
+			}
+		}
+	}
+
+	return sorted, conflicts
+}
+
+// Pattern maps the jobs whose whole id matches an expression to a role.
+type Pattern struct {
+	Kind       string
+	Expression string
+	Role       *Role
+
+	regexp *regexp.Regexp
+	// glob is nil for regexp patterns.
+	glob []globToken
+}
+
+// NewGlobPattern matches job ids with a glob: * matches any sequence of characters, ? a single
+// character, [abc], [a-z] and [!abc] a character in or out of a set, and \ escapes the next character.
+func NewGlobPattern(expression string, role *Role) (*Pattern, error) {
+	tokens, err := parseGlob(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []string
+	for _, token := range tokens {
+		parts = append(parts, token.expression)
+	}
+	compiled, err := regexp.Compile("^(?:" + strings.Join(parts, "") + ")$")
+	if err != nil {
+		return nil, errors.Errorf("Invalid glob %s: %s", expression, err)
+	}
+
+	return &Pattern{GlobPattern, expression, role, compiled, tokens}, nil
+}
+
+// NewRegexpPattern matches job ids with a regular expression, which has to match the whole id. The
+// expression is parsed on its own before being anchored, so it can't escape the anchors.
+func NewRegexpPattern(expression string, role *Role) (*Pattern, error) {
+	parsed, err := syntax.Parse(expression, syntax.Perl)
+	if err != nil {
+		return nil, errors.Errorf("Invalid regexp %s: %s", expression, err)
+	}
+	anchored := &syntax.Regexp{Op: syntax.OpConcat, Sub: []*syntax.Regexp{{Op: syntax.OpBeginText}, parsed, {Op: syntax.OpEndText}}}
+	compiled, err := regexp.Compile(anchored.String())
+	if err != nil {
+		return nil, errors.Errorf("Invalid regexp %s: %s", expression, err)
+	}
+
+	return &Pattern{RegexpPattern, expression, role, compiled, nil}, nil
+}
+
+func (p *Pattern) Match(jobId string) bool {
+	return p.regexp.MatchString(jobId)
+}
+
+func (p *Pattern) String() string {
+	return p.Kind + ":" + p.Expression
+}
+
+// mayOverlap tells whether some job id may match both patterns. It's exact for two globs and
+// conservative otherwise, where only the literal prefixes the patterns require are compared.
+func (p *Pattern) mayOverlap(other *Pattern) bool {
+	if p.glob != nil && other.glob != nil {
+		return globsOverlap(p.glob, other.glob)
+	}
+
+	prefix, _ := p.regexp.LiteralPrefix()
+	otherPrefix, _ := other.regexp.LiteralPrefix()
+	return strings.HasPrefix(prefix, otherPrefix) || strings.HasPrefix(otherPrefix, prefix)
+}
+
+const (
+	globLiteral = iota
+	globAny
+	globStar
+	globClass
+)
+
+type globToken struct {
+	kind    int
+	literal rune
+	class   *regexp.Regexp
+	// expression is the regular expression equivalent to the token.
+	expression string
+}
+
+// matchesSameCharacter tells whether some character matches both single character tokens.
+func (t globToken) matchesSameCharacter(other globToken) bool {
+	switch {
+	case t.kind == globAny || other.kind == globAny:
+		return true
+	case t.kind == globLiteral && other.kind == globLiteral:
+		return t.literal == other.literal
+	case t.kind == globLiteral:
+		return other.class.MatchString(string(t.literal))
+	case other.kind == globLiteral:
+		return t.class.MatchString(string(other.literal))
+	}
+	return true
+}
+
+func parseGlob(expression string) ([]globToken, error) {
+	var tokens []globToken
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '*':
+			if len(tokens) == 0 || tokens[len(tokens)-1].kind != globStar {
+				tokens = append(tokens, globToken{kind: globStar, expression: ".*"})
+			}
+		case '?':
+			tokens = append(tokens, globToken{kind: globAny, expression: "."})
+		case '[':
+			end := i + 1
+			if end < len(runes) && (runes[end] == '!' || runes[end] == '^') {
+				end++
+			}
+			if end < len(runes) && runes[end] == ']' {
+				end++
+			}
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.Errorf("Invalid glob %s: unterminated character class", expression)
+			}
+
+			class := classExpression(runes[i+1 : end])
+			compiled, err := regexp.Compile("^" + class + "$")
+			if err != nil {
+				return nil, errors.Errorf("Invalid glob %s: %s", expression, err)
+			}
+			tokens = append(tokens, globToken{kind: globClass, class: compiled, expression: class})
+			i = end
+		case '\\':
+			if i+1 == len(runes) {
+				return nil, errors.Errorf("Invalid glob %s: trailing escape", expression)
+			}
+			i++
+			fallthrough
+		default:
+			tokens = append(tokens, globToken{kind: globLiteral, literal: runes[i], expression: regexp.QuoteMeta(string(runes[i]))})
+		}
+	}
+
+	return tokens, nil
+}
+
+func classExpression(content []rune) string {
+	expression := "["
+	if len(content) > 0 && (content[0] == '!' || content[0] == '^') {
+		expression += "^"
+		content = content[1:]
+	}
+	for _, r := range content {
+		if r == '-' {
+			expression += "-"
+		} else {
+			expression += regexp.QuoteMeta(string(r))
+		}
+	}
+	return expression + "]"
+}
+
+// globsOverlap tells whether some string matches both globs.
+func globsOverlap(a []globToken, b []globToken) bool {
+	memo := make(map[[2]int]bool)
+
+	var overlap func(i, j int) bool
+	overlap = func(i, j int) bool {
+		if i == len(a) && j == len(b) {
+			return true
+		}
+		key := [2]int{i, j}
+		if result, ok := memo[key]; ok {
+			return result
+		}
+
+		result := false
+		switch {
+		case i < len(a) && a[i].kind == globStar:
+			result = overlap(i+1, j) || (j < len(b) && overlap(i, j+1))
+		case j < len(b) && b[j].kind == globStar:
+			result = overlap(i, j+1) || (i < len(a) && overlap(i+1, j))
+		case i < len(a) && j < len(b):
+			result = a[i].matchesSameCharacter(b[j]) && overlap(i+1, j+1)
+		}
+
+		memo[key] = result
+		return result
+	}
+
+	return overlap(0, 0)
+}
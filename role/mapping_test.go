@@ -0,0 +1,289 @@
+package role
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMapping_ExactJobIdBeatsPatterns(t *testing.T) {
+	mapping, err := NewMapping(
+		map[string]*Role{"team_app.1234": NewRole("arn:aws:iam::111111111:myrole/exact")},
+		[]*Pattern{mustGlob(t, "team_app.*", "arn:aws:iam::111111111:myrole/glob")},
+	)
+	assert.Nil(t, err)
+
+	role, ok := mapping.FindRole("team_app.1234")
+	assert.True(t, ok)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/exact"), role)
+
+	role, ok = mapping.FindRole("team_app.5678")
+	assert.True(t, ok)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/glob"), role)
+}
+
+func TestMapping_LongestPatternWins(t *testing.T) {
+	mapping, err := NewMapping(nil, []*Pattern{
+		mustGlob(t, "team_*", "arn:aws:iam::111111111:myrole/team"),
+		mustRegexp(t, `team_app\..+`, "arn:aws:iam::111111111:myrole/app"),
+	})
+	assert.Nil(t, err)
+
+	role, _ := mapping.FindRole("team_app.3f2a-uuid")
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/app"), role)
+
+	role, _ = mapping.FindRole("team_other.3f2a-uuid")
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/team"), role)
+
+	_, ok := mapping.FindRole("otherteam_app.3f2a-uuid")
+	assert.False(t, ok)
+}
+
+func TestMapping_RegexpMustMatchWholeJobId(t *testing.T) {
+	mapping, err := NewMapping(nil, []*Pattern{mustRegexp(t, `team_app\.`, "arn:aws:iam::111111111:myrole/app")})
+	assert.Nil(t, err)
+
+	_, ok := mapping.FindRole("team_app.3f2a-uuid")
+	assert.False(t, ok)
+}
+
+func TestMapping_RejectsOverlappingPatternsOfSameLength(t *testing.T) {
+	_, err := NewMapping(nil, []*Pattern{
+		mustGlob(t, "team_*", "arn:aws:iam::111111111:myrole/team"),
+		mustGlob(t, "*_app.", "arn:aws:iam::111111111:myrole/app"),
+	})
+
+	if assert.IsType(t, &ConflictingRulesError{}, err) {
+		assert.Len(t, err.(*ConflictingRulesError).Conflicts, 1)
+	}
+}
+
+func TestMapping_AcceptsDisjointPatternsOfSameLength(t *testing.T) {
+	_, err := NewMapping(nil, []*Pattern{
+		mustGlob(t, "team_a.*", "arn:aws:iam::111111111:myrole/a"),
+		mustGlob(t, "team_b.*", "arn:aws:iam::111111111:myrole/b"),
+		mustRegexp(t, `team_c.+`, "arn:aws:iam::111111111:myrole/c"),
+	})
+
+	assert.Nil(t, err)
+}
+
+func TestMapping_ComparesLiteralPrefixesOfRegexps(t *testing.T) {
+	cases := []struct {
+		pattern, other *Pattern
+		overlap        bool
+	}{
+		{mustRegexp(t, `team_a.+`, "arn:aws:iam::111111111:myrole/a"), mustRegexp(t, `team_ab+`, "arn:aws:iam::111111111:myrole/b"), true},
+		{mustRegexp(t, `team_a.+`, "arn:aws:iam::111111111:myrole/a"), mustGlob(t, "team_a*x", "arn:aws:iam::111111111:myrole/b"), true},
+		{mustRegexp(t, `(a|b)_.+`, "arn:aws:iam::111111111:myrole/a"), mustGlob(t, "a_team_*", "arn:aws:iam::111111111:myrole/b"), true},
+		{mustRegexp(t, `.*_web`, "arn:aws:iam::111111111:myrole/a"), mustRegexp(t, `.*_api`, "arn:aws:iam::111111111:myrole/b"), true},
+		{mustRegexp(t, `team_a.+`, "arn:aws:iam::111111111:myrole/a"), mustRegexp(t, `team_b.+`, "arn:aws:iam::111111111:myrole/b"), false},
+		{mustRegexp(t, `team_a.+`, "arn:aws:iam::111111111:myrole/a"), mustGlob(t, "team_b*", "arn:aws:iam::111111111:myrole/b"), false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.overlap, c.pattern.mayOverlap(c.other), "%s and %s", c.pattern, c.other)
+		assert.Equal(t, c.overlap, c.other.mayOverlap(c.pattern), "%s and %s", c.other, c.pattern)
+	}
+}
+
+func TestMapping_AcceptsRegexpsThatMayOverlapAndTriesThemInOrder(t *testing.T) {
+	for _, patterns := range [][]*Pattern{
+		{mustRegexp(t, `.*_web`, "arn:aws:iam::111111111:myrole/web"), mustRegexp(t, `.*_api`, "arn:aws:iam::111111111:myrole/api")},
+		{mustRegexp(t, `.*_api`, "arn:aws:iam::111111111:myrole/api"), mustRegexp(t, `.*_web`, "arn:aws:iam::111111111:myrole/web")},
+	} {
+		mapping, err := NewMapping(nil, patterns)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		role, ok := mapping.FindRole("team_web")
+		assert.True(t, ok)
+		assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/web"), role)
+		role, ok = mapping.FindRole("team_api")
+		assert.True(t, ok)
+		assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/api"), role)
+		assert.Equal(t, "regexp:.*_api", mapping.patterns[0].String())
+	}
+}
+
+func TestGlobsOverlap(t *testing.T) {
+	cases := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"team_*", "*_app", true},
+		{"team_a*", "team_b*", false},
+		{"a?c", "ab?", true},
+		{"a[bc]", "a[!bc]", true},
+		{"a[bc]", "ad", false},
+		{"a\\*", "a?", true},
+		{"a\\*", "ab", false},
+		{"*", "", true},
+		{"a*", "", false},
+	}
+
+	for _, c := range cases {
+		a, err := parseGlob(c.a)
+		assert.Nil(t, err)
+		b, err := parseGlob(c.b)
+		assert.Nil(t, err)
+		assert.Equal(t, c.overlap, globsOverlap(a, b), "%s and %s", c.a, c.b)
+	}
+}
+
+func TestNewPatternReturnsErrorForInvalidExpressions(t *testing.T) {
+	_, err := NewGlobPattern("team_[app", NewRole("arn:aws:iam::111111111:myrole/role"))
+	assert.Error(t, err)
+
+	_, err = NewRegexpPattern("team_(app", NewRole("arn:aws:iam::111111111:myrole/role"))
+	assert.Error(t, err)
+
+	_, err = NewRegexpPattern("team_app)|(.*", NewRole("arn:aws:iam::111111111:myrole/role"))
+	assert.Error(t, err, "An expression escaping the anchors should be rejected")
+}
+
+func TestNewRegexpPatternMatchesWholeJobIdOnly(t *testing.T) {
+	pattern, err := NewRegexpPattern(`team_a|team_b\Q)\E`, NewRole("arn:aws:iam::111111111:myrole/role"))
+	assert.Nil(t, err)
+
+	assert.True(t, pattern.Match("team_a"))
+	assert.True(t, pattern.Match("team_b)"))
+	assert.False(t, pattern.Match("team_app"))
+	assert.False(t, pattern.Match("other_team_b)"))
+}
+
+func TestIniFileLoader_LoadsPatterns(t *testing.T) {
+	filePath := writeRolesFile(t, "[roles]\nmyjob = arn:aws:iam::111111111:myrole/role\n"+
+		"[globs]\nteam_app.* = arn:aws:iam::111111111:myrole/glob\n"+
+		"[regexps]\n`team_(web|api)\\..{1,64}` = arn:aws:iam::111111111:myrole/regexp\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	repository, err := NewFileRoleRepository(filePath)
+	assert.Nil(t, err)
+
+	role, err := repository.FindRoleByJobId("team_app.3f2a-uuid")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/glob"), role)
+
+	role, err = repository.FindRoleByJobId("team_api.3f2a-uuid")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/regexp"), role)
+
+	assert.Equal(t, 3, repository.Status().Jobs)
+}
+
+func TestIniFileLoader_ReportsJobsMappedTwice(t *testing.T) {
+	filePath := writeRolesFile(t, "[roles]\nmyjob = arn:aws:iam::111111111:myrole/role\nmyjob = arn:aws:iam::111111111:myrole/other\n"+
+		"[globs]\nteam_* = arn:aws:iam::111111111:myrole/a\nteam_* = arn:aws:iam::111111111:myrole/b\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	_, err := NewFileRoleRepository(filePath)
+
+	if assert.IsType(t, &ConflictingRulesError{}, err) {
+		assert.Len(t, err.(*ConflictingRulesError).Conflicts, 2)
+	}
+}
+
+func TestIniFileLoader_LoadsRoleOptionsFromSections(t *testing.T) {
+	filePath := writeRolesFile(t, "[job:myjob]\nrole = arn:aws:iam::111111111:myrole/role\nduration = 12h\n"+
+		"external_id = my-external-id\nsession_name = batch-${job}\n"+
+		"[glob:team_app.*]\nrole = arn:aws:iam::111111111:myrole/glob\nexternal_id = other-external-id\nvia = arn:aws:iam::111111111:myrole/hub\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	repository, err := NewFileRoleRepository(filePath)
+	assert.Nil(t, err)
+
+	role, err := repository.FindRoleByJobId("myjob")
+	assert.Nil(t, err)
+	assert.Equal(t, &Role{
+		Arn:         "arn:aws:iam::111111111:myrole/role",
+		Duration:    12 * time.Hour,
+		ExternalId:  "my-external-id",
+		SessionName: "batch-${job}",
+	}, role)
+	assert.Equal(t, "batch-myjob", role.ForJob("myjob").SessionName)
+
+	role, err = repository.FindRoleByJobId("team_app.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, &Role{Arn: "arn:aws:iam::111111111:myrole/glob", ExternalId: "other-external-id", Via: "arn:aws:iam::111111111:myrole/hub"}, role)
+}
+
+func TestIniFileLoader_RejectsInvalidRoleOptions(t *testing.T) {
+	for _, section := range []string{
+		"[job:myjob]\nduration = 1h\n",
+		"[job:myjob]\nrole = arn:aws:iam::111111111:myrole/role\nduration = 1m\n",
+		"[job:myjob]\nrole = arn:aws:iam::111111111:myrole/role\nexternal_id = with spaces\n",
+		"[job:myjob]\nrole = arn:aws:iam::111111111:myrole/role\nunknown = option\n",
+		"[job:myjob]\nrole = arn:aws:iam::111111111:myrole/role\nserial_number = arn:aws:iam::111111111:mfa/smaug\n",
+		"[task:myjob]\nrole = arn:aws:iam::111111111:myrole/role\n",
+	} {
+		filePath := writeRolesFile(t, section)
+		_, err := NewFileRoleRepository(filePath)
+		os.RemoveAll(filepath.Dir(filePath))
+
+		assert.Error(t, err, section)
+	}
+}
+
+func TestIniFileLoader_LoadsSessionPolicies(t *testing.T) {
+	filePath := writeRolesFile(t, "[job:myjob]\nrole = arn:aws:iam::111111111:myrole/role\n"+
+		"policy = {\"Version\": \"2012-10-17\", \"Statement\": [{\"Effect\": \"Allow\", \"Action\": \"s3:GetObject\", \"Resource\": \"arn:aws:s3:::bucket/${job.app}/*\"}]}\n"+
+		"[glob:team_*]\nrole = arn:aws:iam::111111111:myrole/team\npolicy_file = team.json\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+	rewriteRolesFile(t, filepath.Join(filepath.Dir(filePath), "team.json"), "{\n  \"Version\": \"2012-10-17\",\n  \"Statement\": []\n}\n")
+
+	repository, err := NewFileRoleRepository(filePath)
+	assert.Nil(t, err)
+
+	role, err := repository.FindRoleByJobId("myjob")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"arn:aws:s3:::bucket/${job.app}/*"}]}`, role.Policy)
+
+	role, err = repository.FindRoleByJobId("team_app.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Version":"2012-10-17","Statement":[]}`, role.Policy)
+}
+
+func TestIniFileLoader_RejectsInvalidSessionPolicies(t *testing.T) {
+	for _, section := range []string{
+		"[job:myjob]\nrole = arn:aws:iam::111111111:myrole/role\npolicy = {\"Version\": \n",
+		"[job:myjob]\nrole = arn:aws:iam::111111111:myrole/role\npolicy = {\"Sid\": \"" + strings.Repeat("x", MaximumPolicyLength) + "\"}\n",
+		"[job:myjob]\nrole = arn:aws:iam::111111111:myrole/role\npolicy_file = missing.json\n",
+	} {
+		filePath := writeRolesFile(t, section)
+		_, err := NewFileRoleRepository(filePath)
+		os.RemoveAll(filepath.Dir(filePath))
+
+		assert.Error(t, err, section)
+	}
+}
+
+func TestIniFileLoader_ReportsJobsWithDifferentOptions(t *testing.T) {
+	filePath := writeRolesFile(t, "[roles]\nmyjob = arn:aws:iam::111111111:myrole/role\n"+
+		"[job:myjob]\nrole = arn:aws:iam::111111111:myrole/role\nexternal_id = my-external-id\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	_, err := NewFileRoleRepository(filePath)
+
+	assert.IsType(t, &ConflictingRulesError{}, err)
+}
+
+func mustGlob(t *testing.T, expression string, roleArn string) *Pattern {
+	pattern, err := NewGlobPattern(expression, NewRole(roleArn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pattern
+}
+
+func mustRegexp(t *testing.T, expression string, roleArn string) *Pattern {
+	pattern, err := NewRegexpPattern(expression, NewRole(roleArn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pattern
+}
@@ -0,0 +1,355 @@
+package role
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/go-errors/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMarathonRoleLabel is the Marathon app label holding the role of its tasks.
+	DefaultMarathonRoleLabel = "SMAUG_ROLE"
+	// DefaultMarathonTTL is how long the apps fetched from Marathon are used before fetching them again.
+	DefaultMarathonTTL = 1 * time.Minute
+	// DefaultMarathonMissInterval is how often an unknown task can make the apps be fetched again.
+	DefaultMarathonMissInterval = 5 * time.Second
+	// DefaultMarathonEventsRetryInterval is how long to wait before reconnecting to the event stream.
+	DefaultMarathonEventsRetryInterval = 5 * time.Second
+)
+
+// Marathon Role Repository
+//
+// MarathonRoleRepository maps the tasks of the Marathon apps having a role label to that role. Apps and
+// their tasks are fetched from the Marathon REST API and cached for TTL, and kept up to date in between
+// with the Marathon event stream when watched. Requests are only served from the cache: stale apps and
+// unknown tasks make the apps be fetched again in the background.
+func NewMarathonRoleRepository(marathonUrl string, options ...func(*MarathonRoleRepository)) *MarathonRoleRepository {
+	repository := &MarathonRoleRepository{
+		url:                 strings.TrimRight(marathonUrl, "/"),
+		Label:               DefaultMarathonRoleLabel,
+		TTL:                 DefaultMarathonTTL,
+		MissInterval:        DefaultMarathonMissInterval,
+		EventsRetryInterval: DefaultMarathonEventsRetryInterval,
+		Client:              &http.Client{Timeout: 10 * time.Second},
+		tasks:               make(map[string]string),
+		apps:                make(map[string]string),
+	}
+
+	for _, option := range options {
+		option(repository)
+	}
+
+	return repository
+}
+
+type MarathonRoleRepository struct {
+	url string
+
+	Label               string
+	TTL                 time.Duration
+	MissInterval        time.Duration
+	EventsRetryInterval time.Duration
+	Client              *http.Client
+
+	mutex sync.RWMutex
+	// tasks maps task ids to app ids, apps maps app ids to roles.
+	tasks  map[string]string
+	apps   map[string]string
+	status LoadStatus
+	stop   chan struct{}
+
+	refreshMutex sync.Mutex
+	refreshing   bool
+	refreshes    sync.WaitGroup
+}
+
+type marathonApp struct {
+	Id     string            `json:"id"`
+	Labels map[string]string `json:"labels"`
+	Tasks  []marathonTask    `json:"tasks"`
+}
+
+type marathonTask struct {
+	Id    string `json:"id"`
+	AppId string `json:"appId"`
+}
+
+func (r *MarathonRoleRepository) FindRoleByJobId(jobId string) (*Role, error) {
+	status := r.Status()
+	if time.Since(status.LastLoad) >= r.TTL {
+		r.refreshInBackground(r.TTL)
+	}
+
+	if arn, ok := r.lookup(jobId); ok {
+		return NewRole(arn), nil
+	}
+
+	// The task may have been started after the apps were fetched, the next refresh or the event
+	// stream will map it.
+	r.refreshInBackground(r.MissInterval)
+
+	if status.LastSuccess.IsZero() {
+		return nil, &SourceUnavailableError{"Marathon", status.LastError}
+	}
+	return nil, &UnknownJobError{jobId}
+}
+
+// Status returns how the last fetch of the apps from Marathon went, Jobs being the number of
+// known tasks of apps with a role.
+func (r *MarathonRoleRepository) Status() LoadStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	status := r.status
+	for _, app := range r.tasks {
+		if _, ok := r.apps[app]; ok {
+			status.Jobs++
+		}
+	}
+	return status
+}
+
+func (r *MarathonRoleRepository) lookup(jobId string) (string, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	role, ok := r.apps[r.tasks[jobId]]
+	return role, ok
+}
+
+// refreshInBackground refreshes the apps in the background unless a refresh is already running.
+func (r *MarathonRoleRepository) refreshInBackground(maxAge time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.refreshing {
+		return
+	}
+	r.refreshing = true
+	r.refreshes.Add(1)
+
+	go func() {
+		defer r.refreshes.Done()
+		r.refresh(maxAge)
+
+		r.mutex.Lock()
+		r.refreshing = false
+		r.mutex.Unlock()
+	}()
+}
+
+// refresh fetches the apps again if they were last fetched more than maxAge ago. The cached apps
+// are kept if Marathon can't be reached.
+func (r *MarathonRoleRepository) refresh(maxAge time.Duration) {
+	r.refreshMutex.Lock()
+	defer r.refreshMutex.Unlock()
+
+	if lastLoad := r.Status().LastLoad; !lastLoad.IsZero() && time.Since(lastLoad) < maxAge {
+		return
+	}
+
+	apps, err := r.fetchApps()
+	now := time.Now()
+	if err != nil {
+		log.Errorf("Could not get apps from Marathon at %s: %s", r.url, err)
+		r.mutex.Lock()
+		r.status.LastLoad = now
+		r.status.LastError = err
+		r.mutex.Unlock()
+		return
+	}
+
+	tasks := make(map[string]string)
+	roles := make(map[string]string)
+	for _, app := range apps {
+		if role := app.Labels[r.Label]; role != "" {
+			roles[app.Id] = role
+		}
+		for _, task := range app.Tasks {
+			tasks[task.Id] = app.Id
+		}
+	}
+
+	r.mutex.Lock()
+	previous := r.apps
+	r.tasks = tasks
+	r.apps = roles
+	r.status = LoadStatus{LastLoad: now, LastSuccess: now}
+	r.mutex.Unlock()
+
+	logRolesDiff(previous, roles)
+}
+
+func (r *MarathonRoleRepository) fetchApps() ([]marathonApp, error) {
+	query := url.Values{"embed": {"apps.tasks"}, "label": {r.Label}}
+	response, err := r.Client.Get(r.url + "/v2/apps?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Marathon answered %s", response.Status)
+	}
+
+	var body struct {
+		Apps []marathonApp `json:"apps"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Apps, nil
+}
+
+// Watch fetches the apps and follows the Marathon event stream to learn about started and stopped
+// tasks and changed app labels without waiting for the TTL. It reconnects when the stream is
+// interrupted.
+func (r *MarathonRoleRepository) Watch() {
+	r.mutex.Lock()
+	if r.stop != nil {
+		r.mutex.Unlock()
+		return
+	}
+	r.stop = make(chan struct{})
+	stop := r.stop
+	r.mutex.Unlock()
+
+	r.refreshInBackground(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	go func() {
+		for {
+			err := r.followEvents(ctx)
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			log.Errorf("Marathon event stream at %s was interrupted, reconnecting: %s", r.url, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(r.EventsRetryInterval):
+			}
+		}
+	}()
+}
+
+// Close stops following the Marathon event stream.
+func (r *MarathonRoleRepository) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+func (r *MarathonRoleRepository) followEvents(ctx context.Context) error {
+	query := url.Values{"event_type": {"status_update_event", "api_post_event", "app_terminated_event"}}
+	request, err := http.NewRequest("GET", r.url+"/v2/events?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+
+	// The stream is long lived, so it can't use the timeout of the client.
+	client := &http.Client{Transport: r.Client.Transport}
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("Marathon answered %s", response.Status)
+	}
+
+	// Events may have been missed while disconnected.
+	r.refresh(0)
+
+	reader := bufio.NewReader(response.Body)
+	var eventType, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return errors.Errorf("Event stream closed")
+			}
+			return err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if data != "" {
+				r.handleEvent(eventType, data)
+			}
+			eventType, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+}
+
+func (r *MarathonRoleRepository) handleEvent(eventType string, data string) {
+	var event struct {
+		EventType     string       `json:"eventType"`
+		TaskId        string       `json:"taskId"`
+		AppId         string       `json:"appId"`
+		TaskStatus    string       `json:"taskStatus"`
+		AppDefinition *marathonApp `json:"appDefinition"`
+	}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		log.Warn("Could not decode Marathon event: ", err)
+		return
+	}
+	if eventType == "" {
+		eventType = event.EventType
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch eventType {
+	case "status_update_event":
+		switch event.TaskStatus {
+		case "TASK_STAGING", "TASK_STARTING", "TASK_RUNNING":
+			r.tasks[event.TaskId] = event.AppId
+		default:
+			delete(r.tasks, event.TaskId)
+		}
+	case "api_post_event":
+		if event.AppDefinition == nil {
+			return
+		}
+		if role := event.AppDefinition.Labels[r.Label]; role != "" {
+			if r.apps[event.AppDefinition.Id] != role {
+				log.Infof("Marathon app %s is now mapped to %s", event.AppDefinition.Id, role)
+			}
+			r.apps[event.AppDefinition.Id] = role
+		} else if _, ok := r.apps[event.AppDefinition.Id]; ok {
+			log.Infof("Marathon app %s is no longer mapped to a role", event.AppDefinition.Id)
+			delete(r.apps, event.AppDefinition.Id)
+		}
+	case "app_terminated_event":
+		delete(r.apps, event.AppId)
+	}
+}
@@ -0,0 +1,276 @@
+package role
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMarathonRoleRepository_FindRoleByJobIdReadsAppLabel(t *testing.T) {
+	marathon := newFakeMarathon()
+	marathon.AddApp("/team/app", "arn:aws:iam::111111111:myrole/app", "team_app.1234")
+	marathon.AddApp("/team/other", "", "team_other.1234")
+	server := httptest.NewServer(marathon)
+	defer server.Close()
+
+	repository := NewMarathonRoleRepository(server.URL)
+	repository.refresh(0)
+
+	role, err := repository.FindRoleByJobId("team_app.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/app"), role)
+
+	_, err = repository.FindRoleByJobId("team_other.1234")
+	assert.IsType(t, &UnknownJobError{}, err)
+
+	assert.Equal(t, "SMAUG_ROLE", marathon.Label())
+}
+
+func TestMarathonRoleRepository_CachesAppsForTTL(t *testing.T) {
+	marathon := newFakeMarathon()
+	marathon.AddApp("/team/app", "arn:aws:iam::111111111:myrole/app", "team_app.1234")
+	server := httptest.NewServer(marathon)
+	defer server.Close()
+
+	repository := NewMarathonRoleRepository(server.URL, func(r *MarathonRoleRepository) {
+		r.MissInterval = time.Hour
+	})
+
+	for i := 0; i < 3; i++ {
+		repository.FindRoleByJobId("team_app.1234")
+		repository.FindRoleByJobId("team_unknown.1234")
+		repository.refreshes.Wait()
+	}
+	assert.Equal(t, 1, marathon.AppsCalls())
+
+	repository.TTL = 0
+	repository.FindRoleByJobId("team_app.1234")
+	repository.refreshes.Wait()
+	assert.Equal(t, 2, marathon.AppsCalls())
+}
+
+func TestMarathonRoleRepository_ServesUnknownTasksFromCacheAndRefreshesInBackground(t *testing.T) {
+	marathon := newFakeMarathon()
+	server := httptest.NewServer(marathon)
+	defer server.Close()
+
+	repository := NewMarathonRoleRepository(server.URL, func(r *MarathonRoleRepository) {
+		r.MissInterval = 0
+	})
+	repository.refresh(0)
+
+	_, err := repository.FindRoleByJobId("team_app.1234")
+	assert.IsType(t, &UnknownJobError{}, err)
+	repository.refreshes.Wait()
+
+	marathon.AddApp("/team/app", "arn:aws:iam::111111111:myrole/app", "team_app.1234")
+	calls := marathon.AppsCalls()
+
+	_, err = repository.FindRoleByJobId("team_app.1234")
+	assert.IsType(t, &UnknownJobError{}, err)
+	repository.refreshes.Wait()
+	assert.Equal(t, calls+1, marathon.AppsCalls())
+
+	role, err := repository.FindRoleByJobId("team_app.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/app"), role)
+}
+
+func TestMarathonRoleRepository_KeepsCachedAppsWhenMarathonFails(t *testing.T) {
+	marathon := newFakeMarathon()
+	marathon.AddApp("/team/app", "arn:aws:iam::111111111:myrole/app", "team_app.1234")
+	server := httptest.NewServer(marathon)
+	defer server.Close()
+
+	repository := NewMarathonRoleRepository(server.URL)
+	repository.refresh(0)
+
+	marathon.Fail(true)
+	repository.TTL = 0
+
+	_, err := repository.FindRoleByJobId("team_app.1234")
+	assert.Nil(t, err)
+	repository.refreshes.Wait()
+
+	role, err := repository.FindRoleByJobId("team_app.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/app"), role)
+	assert.Error(t, repository.Status().LastError)
+}
+
+func TestMarathonRoleRepository_ReturnsErrorWhenMarathonWasNeverReached(t *testing.T) {
+	marathon := newFakeMarathon()
+	marathon.Fail(true)
+	server := httptest.NewServer(marathon)
+	defer server.Close()
+
+	repository := NewMarathonRoleRepository(server.URL)
+
+	_, err := repository.FindRoleByJobId("team_app.1234")
+	assert.IsType(t, &SourceUnavailableError{}, err)
+	repository.refreshes.Wait()
+
+	_, err = repository.FindRoleByJobId("team_app.1234")
+	assert.Error(t, err)
+	assert.False(t, isUnknownJob(err))
+	assert.Error(t, repository.Status().LastError)
+}
+
+func TestMarathonRoleRepository_StatusCountsTasksOfAppsWithRole(t *testing.T) {
+	marathon := newFakeMarathon()
+	marathon.AddApp("/team/app", "arn:aws:iam::111111111:myrole/app", "team_app.1234", "team_app.5678")
+	marathon.AddApp("/team/other", "arn:aws:iam::111111111:myrole/other", "team_other.1234")
+	server := httptest.NewServer(marathon)
+	defer server.Close()
+
+	repository := NewMarathonRoleRepository(server.URL)
+	repository.refresh(0)
+
+	assert.Equal(t, 3, repository.Status().Jobs)
+}
+
+func TestMarathonRoleRepository_WatchFollowsEvents(t *testing.T) {
+	marathon := newFakeMarathon()
+	marathon.AddApp("/team/app", "arn:aws:iam::111111111:myrole/app", "team_app.1234")
+	server := httptest.NewServer(marathon)
+	defer server.Close()
+
+	repository := NewMarathonRoleRepository(server.URL, func(r *MarathonRoleRepository) {
+		r.TTL = time.Hour
+		r.MissInterval = time.Hour
+	})
+	repository.Watch()
+	defer repository.Close()
+
+	marathon.WaitForSubscriber(t)
+
+	marathon.Emit("status_update_event", map[string]string{"taskId": "team_app.5678", "appId": "/team/app", "taskStatus": "TASK_RUNNING"})
+	assertEventuallyMapped(t, repository, "team_app.5678", "arn:aws:iam::111111111:myrole/app")
+
+	marathon.Emit("api_post_event", map[string]interface{}{"appDefinition": map[string]interface{}{
+		"id":     "/team/app",
+		"labels": map[string]string{"SMAUG_ROLE": "arn:aws:iam::111111111:myrole/changed"},
+	}})
+	assertEventuallyMapped(t, repository, "team_app.5678", "arn:aws:iam::111111111:myrole/changed")
+
+	marathon.Emit("status_update_event", map[string]string{"taskId": "team_app.5678", "appId": "/team/app", "taskStatus": "TASK_KILLED"})
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := repository.FindRoleByJobId("team_app.5678"); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err := repository.FindRoleByJobId("team_app.5678")
+	assert.IsType(t, &UnknownJobError{}, err)
+}
+
+func isUnknownJob(err error) bool {
+	_, ok := err.(*UnknownJobError)
+	return ok
+}
+
+// fakeMarathon serves the parts of the Marathon REST API used by MarathonRoleRepository.
+type fakeMarathon struct {
+	mutex     sync.Mutex
+	apps      []marathonApp
+	fail      bool
+	appsCalls int
+	label     string
+	events    chan string
+	connected chan struct{}
+}
+
+func newFakeMarathon() *fakeMarathon {
+	return &fakeMarathon{events: make(chan string, 10), connected: make(chan struct{}, 10)}
+}
+
+func (m *fakeMarathon) AddApp(id string, role string, taskIds ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	app := marathonApp{Id: id, Labels: map[string]string{}}
+	if role != "" {
+		app.Labels[DefaultMarathonRoleLabel] = role
+	}
+	for _, taskId := range taskIds {
+		app.Tasks = append(app.Tasks, marathonTask{taskId, id})
+	}
+	m.apps = append(m.apps, app)
+}
+
+func (m *fakeMarathon) Fail(fail bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.fail = fail
+}
+
+func (m *fakeMarathon) AppsCalls() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.appsCalls
+}
+
+func (m *fakeMarathon) Label() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.label
+}
+
+func (m *fakeMarathon) Emit(eventType string, event interface{}) {
+	encoded, _ := json.Marshal(event)
+	m.events <- fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, encoded)
+}
+
+func (m *fakeMarathon) WaitForSubscriber(t *testing.T) {
+	select {
+	case <-m.connected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Nobody subscribed to the event stream")
+	}
+}
+
+func (m *fakeMarathon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v2/apps":
+		m.mutex.Lock()
+		m.appsCalls++
+		m.label = r.URL.Query().Get("label")
+		fail := m.fail
+		var apps []marathonApp
+		for _, app := range m.apps {
+			if _, ok := app.Labels[m.label]; ok || m.label == "" {
+				apps = append(apps, app)
+			}
+		}
+		m.mutex.Unlock()
+
+		if fail {
+			w.WriteHeader(503)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"apps": apps})
+	case "/v2/events":
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		m.connected <- struct{}{}
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-m.events:
+				fmt.Fprint(w, event)
+				w.(http.Flusher).Flush()
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,291 @@
+package role
+
+import (
+	"encoding/json"
+	"github.com/go-errors/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMesosTTL is how long a snapshot of the Mesos master state is used before fetching it again.
+	// Every fetch downloads the whole state, several megabytes on large clusters, on every replica.
+	DefaultMesosTTL = 30 * time.Second
+	// DefaultMesosMissInterval is how often an unknown or not running task can make the state be fetched again.
+	DefaultMesosMissInterval = 1 * time.Second
+	// DefaultMesosMaxStaleness is how long a snapshot is trusted when the master can't be reached.
+	DefaultMesosMaxStaleness = 1 * time.Minute
+)
+
+// Mesos Role Repository
+//
+// MesosRoleRepository decorates a role repository so only the jobs that are running Mesos tasks get a
+// role, according to the state of the Mesos master. The task, with its framework, name and labels, is
+// handed to the decorated repository if it implements TaskRoleRepository. Requests are only served from
+// the last snapshot of the state: it's fetched every TTL when watched, and in the background when it's
+// stale or doesn't know a task.
+func NewMesosRoleRepository(masterUrl string, repository RoleRepository, options ...func(*MesosRoleRepository)) *MesosRoleRepository {
+	mesos := &MesosRoleRepository{
+		url:          strings.TrimRight(masterUrl, "/"),
+		repository:   repository,
+		TTL:          DefaultMesosTTL,
+		MissInterval: DefaultMesosMissInterval,
+		MaxStaleness: DefaultMesosMaxStaleness,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for _, option := range options {
+		option(mesos)
+	}
+
+	return mesos
+}
+
+type MesosRoleRepository struct {
+	url        string
+	repository RoleRepository
+
+	TTL          time.Duration
+	MissInterval time.Duration
+	MaxStaleness time.Duration
+	Client       *http.Client
+
+	mutex       sync.RWMutex
+	tasks       map[string]*Task
+	lastFetch   time.Time
+	lastSuccess time.Time
+	lastError   error
+
+	fetchMutex sync.Mutex
+	fetching   bool
+	fetches    sync.WaitGroup
+	stop       chan struct{}
+}
+
+type mesosState struct {
+	Frameworks []struct {
+		Id    string `json:"id"`
+		Name  string `json:"name"`
+		Tasks []struct {
+			Id      string `json:"id"`
+			Name    string `json:"name"`
+			State   string `json:"state"`
+			SlaveId string `json:"slave_id"`
+			Labels  []struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			} `json:"labels"`
+		} `json:"tasks"`
+	} `json:"frameworks"`
+	Slaves []struct {
+		Id       string `json:"id"`
+		Hostname string `json:"hostname"`
+	} `json:"slaves"`
+}
+
+func (r *MesosRoleRepository) FindRoleByJobId(jobId string) (*Role, error) {
+	task, err := r.FindTask(jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	if repository, ok := r.repository.(TaskRoleRepository); ok {
+		return repository.FindRoleByTask(task)
+	}
+	return r.repository.FindRoleByJobId(jobId)
+}
+
+// FindTask returns the running task with the id, or a TaskNotRunningError if there's none.
+func (r *MesosRoleRepository) FindTask(taskId string) (*Task, error) {
+	r.mutex.RLock()
+	lastFetch := r.lastFetch
+	r.mutex.RUnlock()
+	if time.Since(lastFetch) >= r.TTL {
+		r.fetchInBackground(r.TTL)
+	}
+
+	task, err := r.runningTask(taskId)
+	if _, ok := err.(*TaskNotRunningError); ok {
+		// The task may have been started after the state was fetched, the next snapshot will know it.
+		r.fetchInBackground(r.MissInterval)
+	}
+
+	return task, err
+}
+
+// Status returns how the last fetch of the Mesos master state went, Jobs being the number of
+// running tasks.
+func (r *MesosRoleRepository) Status() LoadStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	running := 0
+	for _, task := range r.tasks {
+		if task.State == "TASK_RUNNING" {
+			running++
+		}
+	}
+	return LoadStatus{running, r.lastFetch, r.lastSuccess, r.lastError}
+}
+
+// Healthy returns whether the last snapshot of the state is recent enough to be trusted.
+func (r *MesosRoleRepository) Healthy() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return !r.lastSuccess.IsZero() && time.Since(r.lastSuccess) <= r.MaxStaleness
+}
+
+// Watch fetches the state of the master every TTL in the background.
+func (r *MesosRoleRepository) Watch() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(r.TTL)
+		defer ticker.Stop()
+
+		for {
+			r.fetch(0)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(r.stop)
+}
+
+// Close stops fetching the state of the master.
+func (r *MesosRoleRepository) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+func (r *MesosRoleRepository) runningTask(taskId string) (*Task, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if r.lastSuccess.IsZero() || time.Since(r.lastSuccess) > r.MaxStaleness {
+		cause := r.lastError
+		if cause == nil {
+			cause = errors.Errorf("Mesos master state is outdated")
+		}
+		return nil, &SourceUnavailableError{"Mesos", cause}
+	}
+
+	task, ok := r.tasks[taskId]
+	if !ok {
+		return nil, &TaskNotRunningError{JobId: taskId}
+	}
+	if task.State != "TASK_RUNNING" {
+		return nil, &TaskNotRunningError{taskId, task.State}
+	}
+	return task, nil
+}
+
+// fetchInBackground fetches the state in the background unless a fetch is already running.
+func (r *MesosRoleRepository) fetchInBackground(maxAge time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.fetching {
+		return
+	}
+	r.fetching = true
+	r.fetches.Add(1)
+
+	go func() {
+		defer r.fetches.Done()
+		r.fetch(maxAge)
+
+		r.mutex.Lock()
+		r.fetching = false
+		r.mutex.Unlock()
+	}()
+}
+
+// fetch gets a new snapshot of the master state if the last one is older than maxAge.
+func (r *MesosRoleRepository) fetch(maxAge time.Duration) {
+	r.fetchMutex.Lock()
+	defer r.fetchMutex.Unlock()
+
+	r.mutex.RLock()
+	lastFetch := r.lastFetch
+	r.mutex.RUnlock()
+	if !lastFetch.IsZero() && time.Since(lastFetch) < maxAge {
+		return
+	}
+
+	tasks, err := r.fetchTasks()
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lastFetch = now
+	r.lastError = err
+	if err != nil {
+		log.Errorf("Could not get the Mesos master state from %s: %s", r.url, err)
+		return
+	}
+	r.tasks = tasks
+	r.lastSuccess = now
+}
+
+func (r *MesosRoleRepository) fetchTasks() (map[string]*Task, error) {
+	response, err := r.Client.Get(r.url + "/master/state")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Mesos master answered %s", response.Status)
+	}
+
+	var state mesosState
+	if err := json.NewDecoder(response.Body).Decode(&state); err != nil {
+		return nil, err
+	}
+
+	hostnames := make(map[string]string)
+	for _, slave := range state.Slaves {
+		hostnames[slave.Id] = slave.Hostname
+	}
+
+	tasks := make(map[string]*Task)
+	for _, framework := range state.Frameworks {
+		for _, mesosTask := range framework.Tasks {
+			task := &Task{
+				Id:            mesosTask.Id,
+				Name:          mesosTask.Name,
+				State:         mesosTask.State,
+				FrameworkId:   framework.Id,
+				FrameworkName: framework.Name,
+				Labels:        make(map[string]string),
+				AgentId:       mesosTask.SlaveId,
+				AgentHostname: hostnames[mesosTask.SlaveId],
+			}
+			for _, label := range mesosTask.Labels {
+				task.Labels[label.Key] = label.Value
+			}
+			tasks[task.Id] = task
+		}
+	}
+
+	return tasks, nil
+}
@@ -0,0 +1,246 @@
+package role
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMesosRoleRepository_FindRoleByJobIdForRunningTask(t *testing.T) {
+	master := newFakeMesosMaster()
+	master.AddTask("team_app.1234", "team.app", "TASK_RUNNING", nil)
+	server := httptest.NewServer(master)
+	defer server.Close()
+
+	roles := NewInMemoryRoleRepository()
+	roles.AddRole("team_app.1234", "arn:aws:iam::111111111:myrole/role")
+	repository := NewMesosRoleRepository(server.URL, roles)
+	repository.fetch(0)
+
+	role, err := repository.FindRoleByJobId("team_app.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/role"), role)
+}
+
+func TestMesosRoleRepository_FindRoleByJobIdFailsForFinishedOrUnknownTask(t *testing.T) {
+	master := newFakeMesosMaster()
+	master.AddTask("team_app.1234", "team.app", "TASK_FINISHED", nil)
+	server := httptest.NewServer(master)
+	defer server.Close()
+
+	roles := NewInMemoryRoleRepository()
+	roles.AddRole("team_app.1234", "arn:aws:iam::111111111:myrole/role")
+	roles.AddRole("team_app.5678", "arn:aws:iam::111111111:myrole/role")
+	repository := NewMesosRoleRepository(server.URL, roles)
+	repository.fetch(0)
+
+	_, err := repository.FindRoleByJobId("team_app.1234")
+	assert.Equal(t, &TaskNotRunningError{"team_app.1234", "TASK_FINISHED"}, err)
+
+	_, err = repository.FindRoleByJobId("team_app.5678")
+	assert.Equal(t, &TaskNotRunningError{JobId: "team_app.5678"}, err)
+}
+
+func TestMesosRoleRepository_ExposesTaskToMapping(t *testing.T) {
+	master := newFakeMesosMaster()
+	master.AddTask("team_app.1234", "team.app", "TASK_RUNNING", map[string]string{"SMAUG_ROLE": "arn:aws:iam::111111111:myrole/label"})
+	master.AddTask("team_web.1234", "team.web", "TASK_RUNNING", nil)
+	server := httptest.NewServer(master)
+	defer server.Close()
+
+	labels := NewMesosRoleRepository(server.URL, NewTaskLabelRoleRepository("SMAUG_ROLE"))
+	labels.fetch(0)
+	role, err := labels.FindRoleByJobId("team_app.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/label"), role)
+
+	filePath := writeRolesFile(t, "[task-names]\nmarathon/team.* = arn:aws:iam::111111111:myrole/team\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+	fileRepository, err := NewFileRoleRepository(filePath)
+	assert.Nil(t, err)
+
+	names := NewMesosRoleRepository(server.URL, fileRepository)
+	names.fetch(0)
+	role, err = names.FindRoleByJobId("team_web.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/team"), role)
+
+	task, err := names.FindTask("team_web.1234")
+	assert.Nil(t, err)
+	assert.Equal(t, "marathon", task.FrameworkName)
+	assert.Equal(t, "agent-1.example.com", task.AgentHostname)
+}
+
+func TestMesosRoleRepository_CachesStateSnapshots(t *testing.T) {
+	master := newFakeMesosMaster()
+	master.AddTask("team_app.1234", "team.app", "TASK_RUNNING", nil)
+	server := httptest.NewServer(master)
+	defer server.Close()
+
+	roles := NewInMemoryRoleRepository()
+	roles.AddRole("team_app.1234", "arn:aws:iam::111111111:myrole/role")
+	repository := NewMesosRoleRepository(server.URL, roles, func(r *MesosRoleRepository) {
+		r.TTL = time.Hour
+		r.MissInterval = time.Hour
+	})
+
+	for i := 0; i < 3; i++ {
+		repository.FindRoleByJobId("team_app.1234")
+		repository.FindRoleByJobId("team_app.5678")
+		repository.fetches.Wait()
+	}
+	assert.Equal(t, 1, master.Calls())
+}
+
+func TestMesosRoleRepository_RefetchesStateInBackgroundForUnknownTask(t *testing.T) {
+	master := newFakeMesosMaster()
+	server := httptest.NewServer(master)
+	defer server.Close()
+
+	roles := NewInMemoryRoleRepository()
+	roles.AddRole("team_app.1234", "arn:aws:iam::111111111:myrole/role")
+	repository := NewMesosRoleRepository(server.URL, roles, func(r *MesosRoleRepository) {
+		r.TTL = time.Hour
+		r.MissInterval = 0
+	})
+
+	repository.fetch(0)
+
+	_, err := repository.FindRoleByJobId("team_app.1234")
+	assert.IsType(t, &TaskNotRunningError{}, err)
+	repository.fetches.Wait()
+
+	master.AddTask("team_app.1234", "team.app", "TASK_RUNNING", nil)
+	_, err = repository.FindRoleByJobId("team_app.1234")
+	assert.IsType(t, &TaskNotRunningError{}, err, "The request should be served from the last snapshot")
+	repository.fetches.Wait()
+
+	_, err = repository.FindRoleByJobId("team_app.1234")
+	assert.Nil(t, err)
+}
+
+func TestMesosRoleRepository_FailsWhenMasterCantBeReached(t *testing.T) {
+	master := newFakeMesosMaster()
+	master.AddTask("team_app.1234", "team.app", "TASK_RUNNING", nil)
+	server := httptest.NewServer(master)
+	defer server.Close()
+
+	roles := NewInMemoryRoleRepository()
+	roles.AddRole("team_app.1234", "arn:aws:iam::111111111:myrole/role")
+	repository := NewMesosRoleRepository(server.URL, roles, func(r *MesosRoleRepository) {
+		r.TTL = 0
+		r.MaxStaleness = time.Hour
+	})
+
+	_, err := repository.FindRoleByJobId("team_app.1234")
+	assert.IsType(t, &SourceUnavailableError{}, err)
+	assert.False(t, repository.Healthy())
+	repository.fetches.Wait()
+
+	_, err = repository.FindRoleByJobId("team_app.1234")
+	assert.Nil(t, err)
+	repository.fetches.Wait()
+	assert.True(t, repository.Healthy())
+
+	master.Fail(true)
+	_, err = repository.FindRoleByJobId("team_app.1234")
+	repository.fetches.Wait()
+	assert.Nil(t, err, "A recent snapshot should be trusted")
+	assert.Error(t, repository.Status().LastError)
+	assert.True(t, repository.Healthy())
+
+	repository.MaxStaleness = 0
+	_, err = repository.FindRoleByJobId("team_app.1234")
+	repository.fetches.Wait()
+	assert.IsType(t, &SourceUnavailableError{}, err)
+	assert.False(t, repository.Healthy())
+}
+
+func TestMesosRoleRepository_WatchFetchesStateEveryTTL(t *testing.T) {
+	master := newFakeMesosMaster()
+	master.AddTask("team_app.1234", "team.app", "TASK_RUNNING", nil)
+	master.AddTask("team_app.5678", "team.app", "TASK_FINISHED", nil)
+	server := httptest.NewServer(master)
+	defer server.Close()
+
+	repository := NewMesosRoleRepository(server.URL, NewInMemoryRoleRepository(), func(r *MesosRoleRepository) {
+		r.TTL = 10 * time.Millisecond
+	})
+	repository.Watch()
+	defer repository.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for master.Calls() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.True(t, master.Calls() >= 3)
+	assert.Equal(t, 1, repository.Status().Jobs)
+}
+
+// fakeMesosMaster serves the /master/state endpoint of a Mesos master running Marathon tasks on a single agent.
+type fakeMesosMaster struct {
+	mutex sync.Mutex
+	tasks []map[string]interface{}
+	fail  bool
+	calls int
+}
+
+func newFakeMesosMaster() *fakeMesosMaster {
+	return &fakeMesosMaster{}
+}
+
+func (m *fakeMesosMaster) AddTask(id string, name string, state string, labels map[string]string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var mesosLabels []map[string]string
+	for key, value := range labels {
+		mesosLabels = append(mesosLabels, map[string]string{"key": key, "value": value})
+	}
+	m.tasks = append(m.tasks, map[string]interface{}{
+		"id": id, "name": name, "state": state, "slave_id": "agent-1", "labels": mesosLabels,
+	})
+}
+
+func (m *fakeMesosMaster) Fail(fail bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.fail = fail
+}
+
+func (m *fakeMesosMaster) Calls() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.calls
+}
+
+func (m *fakeMesosMaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/master/state" {
+		http.NotFound(w, r)
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.calls++
+	if m.fail {
+		w.WriteHeader(503)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"frameworks": []interface{}{
+			map[string]interface{}{"id": "framework-1", "name": "marathon", "tasks": m.tasks},
+		},
+		"slaves": []interface{}{
+			map[string]interface{}{"id": "agent-1", "hostname": "agent-1.example.com"},
+		},
+	})
+}
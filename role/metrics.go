@@ -0,0 +1,48 @@
+package role
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smaug_roles_reloads_total",
+		Help: "Roles file reloads by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(Collectors()...)
+}
+
+// Collectors returns the metrics of the reloads of all the roles files.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{reloads}
+}
+
+// Collectors returns the metrics of the roles loaded by the repository.
+func (r *FileRoleRepository) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "smaug_roles_mapped_jobs",
+			Help: "Number of jobs mapped to a role.",
+		}, func() float64 {
+			return float64(r.Status().Jobs)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "smaug_roles_last_reload_timestamp_seconds",
+			Help: "Unix time of the last load of the roles file.",
+		}, func() float64 {
+			return float64(r.Status().LastLoad.UnixNano()) / 1e9
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "smaug_roles_last_reload_success",
+			Help: "Whether the last load of the roles file succeeded.",
+		}, func() float64 {
+			if r.Status().LastError != nil {
+				return 0
+			}
+			return 1
+		}),
+	}
+}
@@ -1,12 +1,19 @@
 package role
 
 import (
+	"fmt"
 	"github.com/go-errors/errors"
 	"github.com/go-ini/ini"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type RoleRepository interface {
-	FindRoleByJobId(string) (string, error)
+	FindRoleByJobId(string) (*Role, error)
 }
 
 // InMemory Role Repository
@@ -15,32 +22,49 @@ func NewInMemoryRoleRepository() *InMemoryRoleRepository {
 }
 
 type InMemoryRoleRepository struct {
-	roles map[string]string
+	roles map[string]*Role
 }
 
 func (r *InMemoryRoleRepository) AddRole(jobId string, roleArn string) {
+	r.SetRole(jobId, NewRole(roleArn))
+}
+func (r *InMemoryRoleRepository) SetRole(jobId string, role *Role) {
 	if r.roles == nil {
-		r.roles = make(map[string]string)
+		r.roles = make(map[string]*Role)
 	}
-	r.roles[jobId] = roleArn
+	r.roles[jobId] = role
 }
-func (r *InMemoryRoleRepository) FindRoleByJobId(jobId string) (string, error) {
+func (r *InMemoryRoleRepository) FindRoleByJobId(jobId string) (*Role, error) {
 	if role, ok := r.roles[jobId]; ok {
 		return role, nil
 	}
 
-	return "", errors.Errorf("Role for job %s do not exist", jobId)
+	return nil, &UnknownJobError{jobId}
 }
 
 type FileRoleRepository struct {
-	path  string
-	roles map[string]string
+	path    string
+	mutex   sync.RWMutex
+	mapping *Mapping
+	status  LoadStatus
+	stop    chan struct{}
+}
+
+// LoadStatus describes the last load of the roles file.
+type LoadStatus struct {
+	// Jobs is the number of rules mapping jobs to a role, exact job ids and patterns.
+	Jobs int
+	// LastLoad is when the roles file was last loaded, successfully or not.
+	LastLoad time.Time
+	// LastSuccess is when the roles file was last loaded successfully.
+	LastSuccess time.Time
+	// LastError is the error of the last load, nil if it succeeded.
+	LastError error
 }
 
 // File Role Repository
 func NewFileRoleRepository(file string) (*FileRoleRepository, error) {
-	roles := make(map[string]string)
-	repository := &FileRoleRepository{file, roles}
+	repository := &FileRoleRepository{path: file}
 	err := repository.loadRolesFromFile()
 
 	if err != nil {
@@ -52,26 +76,81 @@ func NewFileRoleRepository(file string) (*FileRoleRepository, error) {
 
 func (r *FileRoleRepository) loadRolesFromFile() error {
 	loader := NewIniFileLoader(r.path)
-	roles, err := loader.Load()
+	mapping, err := loader.Load()
 
 	if err != nil {
 		return err
 	}
 
-	r.roles = roles
+	now := time.Now()
+	r.mutex.Lock()
+	r.mapping = mapping
+	r.status = LoadStatus{mapping.Len(), now, now, nil}
+	r.mutex.Unlock()
 	return nil
 }
 
-func (r *FileRoleRepository) FindRoleByJobId(jobId string) (string, error) {
-	if role, ok := r.roles[jobId]; ok {
+// Reload reads the roles file again and replaces the current mapping with it.
+// If the file can't be loaded the last good mapping is kept and the error is returned.
+func (r *FileRoleRepository) Reload() error {
+	loader := NewIniFileLoader(r.path)
+	mapping, err := loader.Load()
+
+	if err != nil {
+		log.Errorf("Could not reload roles from %s, keeping previous mapping: %s", r.path, err)
+		r.mutex.Lock()
+		r.status.LastLoad = time.Now()
+		r.status.LastError = err
+		r.mutex.Unlock()
+		reloads.WithLabelValues("Error").Inc()
+		return err
+	}
+
+	now := time.Now()
+	r.mutex.Lock()
+	previous := r.mapping
+	r.mapping = mapping
+	r.status = LoadStatus{mapping.Len(), now, now, nil}
+	r.mutex.Unlock()
+	reloads.WithLabelValues("Success").Inc()
+
+	logRolesDiff(previous.Rules(), mapping.Rules())
+	return nil
+}
+
+// Status returns how the last load of the roles file went.
+func (r *FileRoleRepository) Status() LoadStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.status
+}
+
+func (r *FileRoleRepository) FindRoleByJobId(jobId string) (*Role, error) {
+	r.mutex.RLock()
+	role, ok := r.mapping.FindRole(jobId)
+	r.mutex.RUnlock()
+
+	if ok {
+		return role, nil
+	}
+
+	return nil, &UnknownJobError{jobId}
+}
+
+func (r *FileRoleRepository) FindRoleByTask(task *Task) (*Role, error) {
+	r.mutex.RLock()
+	role, ok := r.mapping.FindRoleForTask(task)
+	r.mutex.RUnlock()
+
+	if ok {
 		return role, nil
 	}
 
-	return "", errors.Errorf("Role for job %s do not exist", jobId)
+	return nil, &UnknownJobError{task.Id}
 }
 
 type FileLoader interface {
-	Load() (map[string]string, error)
+	Load() (*Mapping, error)
 }
 
 // Ini File Loader
@@ -83,20 +162,185 @@ type IniFileLoader struct {
 	path string
 }
 
-func (l *IniFileLoader) Load() (map[string]string, error) {
-	cfg, err := ini.Load(l.path)
+// Load reads exact job ids from the [roles] section, globs from [globs] and regular expressions
+// from [regexps]. Globs in [task-names] match framework/name of the tasks resolved by Mesos.
+// Patterns containing = or : have to be quoted with backticks.
+//
+// Mappings with assume role options have a section each, named job:<job id>, glob:<glob> or
+// regexp:<regular expression>, with the role and its options as keys:
+//
+//	[job:my-batch-job]
+//	role = arn:aws:iam::111111111:role/batch
+//	duration = 12h
+//	external_id = my-external-id
+//	session_name = batch-${job}
+//	policy_file = policies/batch.json
+//	via = arn:aws:iam::111111111:role/hub
+//
+// A session policy is either inline JSON in policy, or read from policy_file, relative to the
+// directory of the roles file. Roles requiring MFA aren't supported, as STS needs a token code
+// from the device.
+func (l *IniFileLoader) Load() (*Mapping, error) {
+	cfg, err := ini.LoadSources(ini.LoadOptions{AllowShadows: true}, l.path)
 
 	if err != nil {
 		return nil, err
 	}
 
-	section := cfg.Section("roles")
-	keys := section.Keys()
+	var conflicts []string
+	var policyFiles []string
 
-	roles := make(map[string]string)
-	for _, key := range keys {
-		roles[key.Name()] = key.Value()
+	roles := make(map[string]*Role)
+	for _, key := range cfg.Section("roles").Keys() {
+		values := key.ValueWithShadows()
+		if len(distinct(values)) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("job %s is mapped to roles %s", key.Name(), strings.Join(distinct(values), ", ")))
+		}
+		roles[key.Name()] = NewRole(values[0])
 	}
 
-	return roles, nil
+	var patterns []*Pattern
+	for _, section := range []struct {
+		name       string
+		newPattern func(string, *Role) (*Pattern, error)
+	}{{"globs", NewGlobPattern}, {"regexps", NewRegexpPattern}} {
+		for _, key := range cfg.Section(section.name).Keys() {
+			for _, value := range distinct(key.ValueWithShadows()) {
+				pattern, err := section.newPattern(key.Name(), NewRole(value))
+				if err != nil {
+					return nil, err
+				}
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+
+	var taskNames []*Pattern
+	for _, key := range cfg.Section("task-names").Keys() {
+		for _, value := range distinct(key.ValueWithShadows()) {
+			pattern, err := NewGlobPattern(key.Name(), NewRole(value))
+			if err != nil {
+				return nil, err
+			}
+			taskNames = append(taskNames, pattern)
+		}
+	}
+
+	for _, section := range cfg.Sections() {
+		separator := strings.Index(section.Name(), ":")
+		if separator < 0 {
+			continue
+		}
+		kind, expression := section.Name()[:separator], section.Name()[separator+1:]
+
+		role, policyFile, err := roleFromSection(section, filepath.Dir(l.path))
+		if err != nil {
+			return nil, err
+		}
+		if policyFile != "" {
+			policyFiles = append(policyFiles, policyFile)
+		}
+
+		switch kind {
+		case "job":
+			if previous, ok := roles[expression]; ok && *previous != *role {
+				conflicts = append(conflicts, fmt.Sprintf("job %s is mapped to roles %s, %s", expression, previous, role))
+			}
+			roles[expression] = role
+		case GlobPattern, RegexpPattern:
+			newPattern := NewGlobPattern
+			if kind == RegexpPattern {
+				newPattern = NewRegexpPattern
+			}
+			pattern, err := newPattern(expression, role)
+			if err != nil {
+				return nil, err
+			}
+			patterns = append(patterns, pattern)
+		default:
+			return nil, errors.Errorf("Unknown kind of mapping in section %s", section.Name())
+		}
+	}
+
+	mapping, err := NewMapping(roles, patterns)
+	if conflictErr, ok := err.(*ConflictingRulesError); ok {
+		conflicts = append(conflicts, conflictErr.Conflicts...)
+	} else if err != nil {
+		return nil, err
+	}
+
+	sortedTaskNames, taskNameConflicts := sortPatterns(taskNames)
+	conflicts = append(conflicts, taskNameConflicts...)
+	if len(conflicts) > 0 {
+		return nil, &ConflictingRulesError{conflicts}
+	}
+
+	mapping.taskNames = sortedTaskNames
+	mapping.policyFiles = policyFiles
+	return mapping, nil
+}
+
+// roleFromSection reads a role and its assume role options from the keys of a section, and returns
+// the policy file it read if any. Policy files are relative to dir.
+func roleFromSection(section *ini.Section, dir string) (*Role, string, error) {
+	role := &Role{}
+	var policyFile string
+	for _, key := range section.Keys() {
+		switch key.Name() {
+		case "role":
+			role.Arn = key.Value()
+		case "duration":
+			duration, err := time.ParseDuration(key.Value())
+			if err != nil {
+				return nil, "", errors.Errorf("Invalid duration in section %s: %s", section.Name(), key.Value())
+			}
+			role.Duration = duration
+		case "external_id":
+			role.ExternalId = key.Value()
+		case "session_name":
+			role.SessionName = key.Value()
+		case "serial_number":
+			return nil, "", errors.Errorf("Option serial_number in section %s isn't supported: roles requiring MFA need a token code from the device, which smaug can't provide", section.Name())
+		case "policy":
+			role.Policy = key.Value()
+		case "via":
+			role.Via = key.Value()
+		case "policy_file":
+			policyFile = key.Value()
+			if !filepath.IsAbs(policyFile) {
+				policyFile = filepath.Join(dir, policyFile)
+			}
+			policy, err := ioutil.ReadFile(policyFile)
+			if err != nil {
+				return nil, "", errors.Errorf("Could not read session policy of section %s: %s", section.Name(), err)
+			}
+			role.Policy = string(policy)
+		default:
+			return nil, "", errors.Errorf("Unknown option %s in section %s", key.Name(), section.Name())
+		}
+	}
+
+	if section.HasKey("policy") && section.HasKey("policy_file") {
+		return nil, "", errors.Errorf("Section %s has both a policy and a policy file", section.Name())
+	}
+	if err := role.Validate(); err != nil {
+		return nil, "", errors.Errorf("Invalid role in section %s: %s", section.Name(), err)
+	}
+	if role.Policy != "" {
+		// Policies are stored compacted, so they're shorter and only change when their JSON does.
+		role.Policy, _ = compactPolicy(role.Policy)
+	}
+	return role, policyFile, nil
+}
+
+func distinct(values []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result
 }
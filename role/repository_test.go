@@ -16,7 +16,7 @@ func TestInMemoryRepository_FindRoleByJobName(t *testing.T) {
 	arnRole, err := inMemoryRoleRepository.FindRoleByJobId(jobId)
 
 	assert.Nil(t, err)
-	assert.Equal(t, expectedRoleArn, arnRole)
+	assert.Equal(t, expectedRoleArn, arnRole.Arn)
 }
 
 func TestInMemoryRepository_FindRoleByJobNameReturnsError(t *testing.T) {
@@ -49,6 +49,6 @@ func TestFileRoleRepository_FindRoleByJobName(t *testing.T) {
 	role, err := repository.FindRoleByJobId(jobId)
 
 	assert.Nil(t, err)
-	assert.Equal(t, "arn:aws:iam::111111111:myrole/role", role)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/role"), role)
 
 }
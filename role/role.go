@@ -0,0 +1,168 @@
+package role
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-errors/errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	MinimumDuration = 15 * time.Minute
+	MaximumDuration = 12 * time.Hour
+	// MaximumSessionNameLength is the longest role session name STS accepts.
+	MaximumSessionNameLength = 64
+	// MaximumPolicyLength is the longest inline session policy STS accepts, without whitespace.
+	MaximumPolicyLength = 2048
+	// MaximumChainedDuration is the longest STS allows credentials of a role assumed with the
+	// credentials of another role to last.
+	MaximumChainedDuration = 1 * time.Hour
+)
+
+var (
+	externalIdRegex         = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+	invalidSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+)
+
+// Role is a role a job gets and how it has to be assumed.
+type Role struct {
+	Arn string
+	// Duration of the credentials, the default of the credentials repository if zero.
+	Duration time.Duration
+	// ExternalId is required by the trust policy of some cross-account roles.
+	ExternalId string
+	// SessionName is the template of the role session name, ${job} is replaced with the job id and
+	// ${app} with the id of its app.
+	SessionName string
+	// Policy is an inline session policy narrowing the permissions of the role, a JSON template with
+	// the same variables as SessionName.
+	Policy string
+	// Via is the arn of the hub role this role is assumed with, empty to assume it directly.
+	Via string
+}
+
+// NewRole returns a role assumed with the default options.
+func NewRole(arn string) *Role {
+	return &Role{Arn: arn}
+}
+
+// Validate checks the options are accepted by STS.
+func (r *Role) Validate() error {
+	if r.Arn == "" {
+		return errors.Errorf("Role arn is missing")
+	}
+	if r.Duration != 0 && (r.Duration < MinimumDuration || r.Duration > MaximumDuration) {
+		return errors.Errorf("Duration of role %s must be between %s and %s: %s", r.Arn, MinimumDuration, MaximumDuration, r.Duration)
+	}
+	if r.ExternalId != "" && (len(r.ExternalId) < 2 || len(r.ExternalId) > 1224 || !externalIdRegex.MatchString(r.ExternalId)) {
+		return errors.Errorf("Invalid external id for role %s", r.Arn)
+	}
+	if r.Via != "" && r.Duration > MaximumChainedDuration {
+		return errors.Errorf("Duration of role %s can't be longer than %s as it's assumed via %s: %s", r.Arn, MaximumChainedDuration, r.Via, r.Duration)
+	}
+	if r.Policy != "" {
+		policy, err := compactPolicy(r.Policy)
+		if err != nil {
+			return errors.Errorf("Invalid session policy for role %s: %s", r.Arn, err)
+		}
+		if len(policy) > MaximumPolicyLength {
+			return errors.Errorf("Session policy for role %s is %d characters long, more than the %d STS accepts", r.Arn, len(policy), MaximumPolicyLength)
+		}
+	}
+	return nil
+}
+
+// compactPolicy checks a policy is JSON and removes its whitespace, which doesn't count for STS.
+func compactPolicy(policy string) (string, error) {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, []byte(policy)); err != nil {
+		return "", err
+	}
+	return compacted.String(), nil
+}
+
+// ForJob returns the role with the templates expanded for the job.
+func (r *Role) ForJob(jobId string) *Role {
+	role := *r
+	if role.SessionName != "" {
+		role.SessionName = SessionName(ExpandTemplate(role.SessionName, jobId))
+	}
+	if role.Policy != "" {
+		role.Policy = expandTemplate(role.Policy, jobId, escapeJSON)
+	}
+	return &role
+}
+
+// ExpandTemplate replaces ${job} and ${job.id} with the job id, and ${app} and ${job.app} with the
+// id of its app.
+func ExpandTemplate(template string, jobId string) string {
+	return expandTemplate(template, jobId, func(value string) string { return value })
+}
+
+func expandTemplate(template string, jobId string, escape func(string) string) string {
+	job, app := escape(jobId), escape(AppId(jobId))
+	return strings.NewReplacer("${job}", job, "${job.id}", job, "${app}", app, "${job.app}", app).Replace(template)
+}
+
+// escapeJSON escapes a value to be put in a JSON string.
+func escapeJSON(value string) string {
+	encoded, _ := json.Marshal(value)
+	return string(encoded[1 : len(encoded)-1])
+}
+
+// AppId returns the id of the app a task belongs to, which is the task id up to its last dot for
+// the tasks launched by Marathon.
+func AppId(jobId string) string {
+	if dot := strings.LastIndex(jobId, "."); dot > 0 {
+		return jobId[:dot]
+	}
+	return jobId
+}
+
+// SessionName turns a name into a role session name STS accepts. The characters STS doesn't allow
+// are replaced with dashes, and names that are too long are cut and end with a hash of the whole
+// name, so two long job ids don't get the same session name.
+func SessionName(name string) string {
+	name = invalidSessionNameChars.ReplaceAllString(name, "-")
+	for len(name) < 2 {
+		name += "-"
+	}
+	if len(name) <= MaximumSessionNameLength {
+		return name
+	}
+
+	hash := sha1.Sum([]byte(name))
+	suffix := "-" + hex.EncodeToString(hash[:])[:12]
+	return name[:MaximumSessionNameLength-len(suffix)] + suffix
+}
+
+// String returns the arn followed by the options that aren't the default ones.
+func (r *Role) String() string {
+	var options []string
+	if r.Duration != 0 {
+		options = append(options, "duration "+r.Duration.String())
+	}
+	if r.ExternalId != "" {
+		options = append(options, "external id "+r.ExternalId)
+	}
+	if r.SessionName != "" {
+		options = append(options, "session name "+r.SessionName)
+	}
+	if r.Policy != "" {
+		hash := sha1.Sum([]byte(r.Policy))
+		options = append(options, "session policy "+hex.EncodeToString(hash[:])[:12])
+	}
+	if r.Via != "" {
+		options = append(options, "via "+r.Via)
+	}
+
+	if len(options) == 0 {
+		return r.Arn
+	}
+	return fmt.Sprintf("%s (%s)", r.Arn, strings.Join(options, ", "))
+}
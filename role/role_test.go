@@ -0,0 +1,44 @@
+package role
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRole_ForJobExpandsSessionName(t *testing.T) {
+	role := &Role{Arn: "arn:aws:iam::111111111:myrole/role", SessionName: "${app}/${job}"}
+
+	assert.Equal(t, "team_app-team_app.1234", role.ForJob("team_app.1234").SessionName)
+	assert.Equal(t, "${app}/${job}", role.SessionName)
+	assert.Equal(t, "", NewRole("arn:aws:iam::111111111:myrole/role").ForJob("team_app.1234").SessionName)
+}
+
+func TestRole_ForJobExpandsPolicy(t *testing.T) {
+	role := &Role{Arn: "arn:aws:iam::111111111:myrole/role", Policy: `{"Resource":"arn:aws:s3:::bucket/${job.app}/${job}"}`}
+
+	assert.Equal(t, `{"Resource":"arn:aws:s3:::bucket/team_app/team_app.1234"}`, role.ForJob("team_app.1234").Policy)
+	assert.Equal(t, `{"Resource":"arn:aws:s3:::bucket/team\"app/team\"app.1234"}`, role.ForJob(`team"app.1234`).Policy)
+}
+
+func TestSessionName_MeetsStsLimits(t *testing.T) {
+	assert.Equal(t, "team_app.1234", SessionName("team_app.1234"))
+	assert.Equal(t, "team-app-1234", SessionName("team/app 1234"))
+	assert.Equal(t, "a-", SessionName("a"))
+
+	long := strings.Repeat("team_app", 10) + ".1234"
+	other := strings.Repeat("team_app", 10) + ".5678"
+	assert.Len(t, SessionName(long), MaximumSessionNameLength)
+	assert.True(t, strings.HasPrefix(SessionName(long), "team_app"))
+	assert.NotEqual(t, SessionName(long), SessionName(other))
+}
+
+func TestRole_ValidateChecksOptions(t *testing.T) {
+	assert.Nil(t, (&Role{Arn: "arn:aws:iam::111111111:myrole/role", Duration: time.Hour, ExternalId: "my-external-id"}).Validate())
+	assert.Error(t, (&Role{Duration: time.Hour}).Validate())
+	assert.Error(t, (&Role{Arn: "arn:aws:iam::111111111:myrole/role", Duration: 13 * time.Hour}).Validate())
+	assert.Error(t, (&Role{Arn: "arn:aws:iam::111111111:myrole/role", ExternalId: "x"}).Validate())
+	assert.Error(t, (&Role{Arn: "arn:aws:iam::111111111:myrole/role", Policy: "{"}).Validate())
+	assert.Error(t, (&Role{Arn: "arn:aws:iam::111111111:myrole/role", Via: "arn:aws:iam::111111111:myrole/hub", Duration: 2 * time.Hour}).Validate())
+}
@@ -0,0 +1,50 @@
+package role
+
+// DefaultTaskRoleLabel is the task label holding the role of the task.
+const DefaultTaskRoleLabel = "SMAUG_ROLE"
+
+// Task describes a running job as known by its scheduler.
+type Task struct {
+	Id            string
+	Name          string
+	State         string
+	FrameworkId   string
+	FrameworkName string
+	Labels        map[string]string
+	AgentId       string
+	AgentHostname string
+}
+
+// TaskRoleRepository is implemented by role repositories that can use the details of a task,
+// and not only its id, to find its role.
+type TaskRoleRepository interface {
+	FindRoleByTask(task *Task) (*Role, error)
+}
+
+// TaskLocator finds the running task of a job, telling which agent runs it.
+type TaskLocator interface {
+	FindTask(taskId string) (*Task, error)
+}
+
+// Task Label Role Repository
+//
+// TaskLabelRoleRepository maps tasks to the role in one of their labels. It's meant to be decorated
+// by a repository resolving tasks, like MesosRoleRepository, as it doesn't know any job by its id.
+func NewTaskLabelRoleRepository(label string) *TaskLabelRoleRepository {
+	return &TaskLabelRoleRepository{label}
+}
+
+type TaskLabelRoleRepository struct {
+	label string
+}
+
+func (r *TaskLabelRoleRepository) FindRoleByJobId(jobId string) (*Role, error) {
+	return nil, &UnknownJobError{jobId}
+}
+
+func (r *TaskLabelRoleRepository) FindRoleByTask(task *Task) (*Role, error) {
+	if arn := task.Labels[r.label]; arn != "" {
+		return NewRole(arn), nil
+	}
+	return nil, &UnknownJobError{task.Id}
+}
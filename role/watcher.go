@@ -0,0 +1,133 @@
+package role
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Watch reloads the roles file every time it or one of its policy files changes on disk, or the
+// process receives SIGHUP. The files are polled every interval, a zero interval only reloads on SIGHUP.
+func (r *FileRoleRepository) Watch(interval time.Duration) {
+	r.mutex.Lock()
+	if r.stop != nil {
+		r.mutex.Unlock()
+		return
+	}
+	r.stop = make(chan struct{})
+	stop := r.stop
+	r.mutex.Unlock()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	lastModified := r.filesVersion()
+
+	go func() {
+		defer signal.Stop(signals)
+
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-signals:
+				log.Info("Received SIGHUP, reloading roles from ", r.path)
+				lastModified = r.filesVersion()
+				r.Reload()
+			case <-tick:
+				modified := r.filesVersion()
+				if modified == lastModified {
+					continue
+				}
+				lastModified = modified
+				log.Info("Roles file or policy files changed, reloading roles from ", r.path)
+				r.Reload()
+			}
+		}
+	}()
+}
+
+// Close stops watching the roles file.
+func (r *FileRoleRepository) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+// filesVersion describes the versions of the roles file and of the policy files of the current
+// mapping, it changes when one of them does.
+func (r *FileRoleRepository) filesVersion() string {
+	r.mutex.RLock()
+	files := append([]string{r.path}, r.mapping.policyFiles...)
+	r.mutex.RUnlock()
+
+	var versions []version
+	for _, file := range files {
+		versions = append(versions, fileVersion(file))
+	}
+	return fmt.Sprint(versions)
+}
+
+type version struct {
+	modified time.Time
+	size     int64
+}
+
+func fileVersion(path string) version {
+	info, err := os.Stat(path)
+	if err != nil {
+		return version{}
+	}
+
+	return version{info.ModTime(), info.Size()}
+}
+
+func logRolesDiff(previous map[string]string, current map[string]string) {
+	added, removed, remapped := diffRoles(previous, current)
+
+	for _, jobId := range added {
+		log.Infof("Role mapping added for job %s: %s", jobId, current[jobId])
+	}
+	for _, jobId := range removed {
+		log.Infof("Role mapping removed for job %s: %s", jobId, previous[jobId])
+	}
+	for _, jobId := range remapped {
+		log.Infof("Role mapping changed for job %s: %s -> %s", jobId, previous[jobId], current[jobId])
+	}
+	log.Infof("Roles reloaded: %d added, %d removed, %d remapped", len(added), len(removed), len(remapped))
+}
+
+func diffRoles(previous map[string]string, current map[string]string) (added []string, removed []string, remapped []string) {
+	for jobId, roleArn := range current {
+		previousRoleArn, ok := previous[jobId]
+		if !ok {
+			added = append(added, jobId)
+		} else if previousRoleArn != roleArn {
+			remapped = append(remapped, jobId)
+		}
+	}
+	for jobId := range previous {
+		if _, ok := current[jobId]; !ok {
+			removed = append(removed, jobId)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(remapped)
+	return added, removed, remapped
+}
@@ -0,0 +1,171 @@
+package role
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFileRoleRepository_ReloadReplacesRoles(t *testing.T) {
+	filePath := writeRolesFile(t, "[roles]\nmyjob = arn:aws:iam::111111111:myrole/role\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	repository, err := NewFileRoleRepository(filePath)
+	assert.Nil(t, err)
+
+	rewriteRolesFile(t, filePath, "[roles]\notherjob = arn:aws:iam::111111111:myrole/other\n")
+	assert.Nil(t, repository.Reload())
+
+	_, err = repository.FindRoleByJobId("myjob")
+	assert.Error(t, err)
+
+	role, err := repository.FindRoleByJobId("otherjob")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/other"), role)
+}
+
+func TestFileRoleRepository_ReloadKeepsLastGoodRolesIfFileIsInvalid(t *testing.T) {
+	filePath := writeRolesFile(t, "[roles]\nmyjob = arn:aws:iam::111111111:myrole/role\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	repository, err := NewFileRoleRepository(filePath)
+	assert.Nil(t, err)
+
+	rewriteRolesFile(t, filePath, "[roles\nmyjob = arn:aws:iam::111111111:myrole/other\n")
+	assert.Error(t, repository.Reload())
+
+	role, err := repository.FindRoleByJobId("myjob")
+	assert.Nil(t, err)
+	assert.Equal(t, NewRole("arn:aws:iam::111111111:myrole/role"), role)
+}
+
+func TestFileRoleRepository_WatchReloadsWhenFileChanges(t *testing.T) {
+	filePath := writeRolesFile(t, "[roles]\nmyjob = arn:aws:iam::111111111:myrole/role\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	repository, err := NewFileRoleRepository(filePath)
+	assert.Nil(t, err)
+
+	repository.Watch(10 * time.Millisecond)
+	defer repository.Close()
+
+	rewriteRolesFile(t, filePath, "[roles]\nmyjob = arn:aws:iam::111111111:myrole/changed\n")
+
+	assertEventuallyMapped(t, repository, "myjob", "arn:aws:iam::111111111:myrole/changed")
+}
+
+func TestFileRoleRepository_WatchReloadsWhenPolicyFileChanges(t *testing.T) {
+	filePath := writeRolesFile(t, "[job:myjob]\nrole = arn:aws:iam::111111111:myrole/role\npolicy_file = policy.json\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+	policyPath := filepath.Join(filepath.Dir(filePath), "policy.json")
+	rewriteRolesFile(t, policyPath, `{"Version": "2012-10-17", "Statement": []}`)
+
+	repository, err := NewFileRoleRepository(filePath)
+	assert.Nil(t, err)
+
+	repository.Watch(10 * time.Millisecond)
+	defer repository.Close()
+
+	rewriteRolesFile(t, policyPath, `{"Version": "2012-10-17", "Statement": [{"Effect": "Deny", "Action": "*", "Resource": "*"}]}`)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if role, _ := repository.FindRoleByJobId("myjob"); role != nil && strings.Contains(role.Policy, "Deny") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	role, err := repository.FindRoleByJobId("myjob")
+	assert.Nil(t, err)
+	assert.Contains(t, role.Policy, "Deny")
+}
+
+func TestFileRoleRepository_WatchReloadsOnSighup(t *testing.T) {
+	filePath := writeRolesFile(t, "[roles]\nmyjob = arn:aws:iam::111111111:myrole/role\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	repository, err := NewFileRoleRepository(filePath)
+	assert.Nil(t, err)
+
+	repository.Watch(0)
+	defer repository.Close()
+
+	rewriteRolesFile(t, filePath, "[roles]\nmyjob = arn:aws:iam::111111111:myrole/changed\n")
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+	assertEventuallyMapped(t, repository, "myjob", "arn:aws:iam::111111111:myrole/changed")
+}
+
+func TestDiffRoles(t *testing.T) {
+	previous := map[string]string{
+		"kept":     "arn:aws:iam::111111111:myrole/kept",
+		"removed":  "arn:aws:iam::111111111:myrole/removed",
+		"remapped": "arn:aws:iam::111111111:myrole/before",
+	}
+	current := map[string]string{
+		"kept":     "arn:aws:iam::111111111:myrole/kept",
+		"added":    "arn:aws:iam::111111111:myrole/added",
+		"remapped": "arn:aws:iam::111111111:myrole/after",
+	}
+
+	added, removed, remapped := diffRoles(previous, current)
+
+	assert.Equal(t, []string{"added"}, added)
+	assert.Equal(t, []string{"removed"}, removed)
+	assert.Equal(t, []string{"remapped"}, remapped)
+}
+
+func writeRolesFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "smaug-roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := filepath.Join(dir, "roles.ini")
+	rewriteRolesFile(t, filePath, content)
+	return filePath
+}
+
+func rewriteRolesFile(t *testing.T, filePath string, content string) {
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertEventuallyMapped(t *testing.T, repository RoleRepository, jobId string, expectedRoleArn string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if role, err := repository.FindRoleByJobId(jobId); err == nil && role.Arn == expectedRoleArn {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("Job %s was not mapped to %s", jobId, expectedRoleArn)
+}
+
+func TestFileRoleRepository_StatusDescribesLastLoad(t *testing.T) {
+	filePath := writeRolesFile(t, "[roles]\nmyjob = arn:aws:iam::111111111:myrole/role\n")
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	repository, err := NewFileRoleRepository(filePath)
+	assert.Nil(t, err)
+
+	status := repository.Status()
+	assert.Equal(t, 1, status.Jobs)
+	assert.Nil(t, status.LastError)
+	assert.Equal(t, status.LastLoad, status.LastSuccess)
+
+	rewriteRolesFile(t, filePath, "[roles\n")
+	repository.Reload()
+
+	status = repository.Status()
+	assert.Equal(t, 1, status.Jobs)
+	assert.Error(t, status.LastError)
+	assert.True(t, status.LastLoad.After(status.LastSuccess))
+}
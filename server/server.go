@@ -0,0 +1,570 @@
+// Package server wires the smaug repositories and handlers into an HTTP server with a managed lifecycle,
+// so smaug can be embedded in other binaries.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/go-errors/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/schibsted/smaug/audit"
+	"github.com/schibsted/smaug/credentials"
+	http_pkg "github.com/schibsted/smaug/http"
+	"github.com/schibsted/smaug/role"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultAddress             = ":8080"
+	DefaultRolesReloadInterval = 10 * time.Second
+	DefaultShutdownTimeout     = 30 * time.Second
+
+	RolesFileSource   = "file"
+	MarathonSource    = "marathon"
+	MesosLabelsSource = "mesos-labels"
+)
+
+// Server serves the smaug endpoints. Its exported fields are the options, they can be set with
+// the functions passed to NewServer and must not change after Start.
+func NewServer(options ...func(*Server)) *Server {
+	server := &Server{
+		Address:             DefaultAddress,
+		RolesReloadInterval: DefaultRolesReloadInterval,
+		RoleSources:         []string{RolesFileSource, MarathonSource},
+		MarathonRoleLabel:   role.DefaultMarathonRoleLabel,
+		MesosRoleLabel:      role.DefaultTaskRoleLabel,
+		MesosStateTTL:       role.DefaultMesosTTL,
+		MinimumLifetime:     credentials.DefaultMinimumLifetime,
+		RefreshBefore:       credentials.DefaultRefreshBefore,
+		IdleTimeout:         credentials.DefaultIdleTimeout,
+		SessionName:         credentials.DefaultSessionName,
+		CacheStrategy:       credentials.CachePerRole,
+		TLSReloadInterval:   DefaultTLSReloadInterval,
+		AuditSink:           audit.NopSink{},
+		ShutdownTimeout:     DefaultShutdownTimeout,
+	}
+
+	for _, option := range options {
+		option(server)
+	}
+
+	return server
+}
+
+type Server struct {
+	// Address to listen on.
+	Address string
+
+	// RolesFile is the ini file mapping jobs to roles, it's watched for changes every RolesReloadInterval.
+	RolesFile           string
+	RolesReloadInterval time.Duration
+
+	// MarathonUrl maps the tasks of Marathon apps to the role in their MarathonRoleLabel.
+	MarathonUrl       string
+	MarathonRoleLabel string
+
+	// RoleSources is the order in which the configured sources are asked for the role of a job,
+	// "file" for the RolesFile, "marathon" for Marathon and "mesos-labels" for the MesosRoleLabel
+	// of the Mesos tasks.
+	RoleSources []string
+
+	// DefaultRole is given to the jobs matching the DefaultRolePattern glob that no source knows.
+	DefaultRole        string
+	DefaultRolePattern string
+
+	// RoleRepository maps jobs to roles instead of the role sources.
+	RoleRepository role.RoleRepository
+
+	// MesosMasterUrl makes only the jobs that are running Mesos tasks get a role. The "mesos-labels"
+	// source maps the tasks to the role in their MesosRoleLabel.
+	MesosMasterUrl string
+	MesosRoleLabel string
+	// MesosStateTTL is how often the whole state of the Mesos master is downloaded.
+	MesosStateTTL time.Duration
+
+	// AgentBinding refuses the credentials of jobs to other callers than the agents running their
+	// tasks, identified by http.AgentIdentityAddress or http.AgentIdentityCertificate, it's disabled
+	// if empty. The tasks are found by TaskLocator, the Mesos master by default.
+	AgentBinding string
+	TaskLocator  role.TaskLocator
+
+	// StsClient assumes the roles, defaults to a client configured by Sts.
+	StsClient stsiface.STSAPI
+	Sts       credentials.StsConfig
+
+	MinimumLifetime time.Duration
+	RefreshBefore   time.Duration
+	IdleTimeout     time.Duration
+
+	// SessionName is the template of the role session names, ${job} and ${app} are replaced with
+	// the job and its app. It's only used with the CachePerJob strategy.
+	SessionName string
+
+	// CacheStrategy is credentials.CachePerRole, the default, for the jobs of a role to share its
+	// credentials, or credentials.CachePerJob for jobs to get credentials of their own, which makes
+	// an AssumeRole call per job and per refresh.
+	CacheStrategy string
+
+	// ContainerTokenKey derives the container authorization tokens, a random one is used if not set.
+	ContainerTokenKey []byte
+
+	// SchedulerToken enables the /container-tokens/ endpoint for the scheduler bearing it.
+	SchedulerToken string
+
+	// TLSCertFile and TLSKeyFile make the server serve HTTPS. With a ClientCAFile, /credentials requires
+	// a client certificate signed by one of its CAs, with one of the AllowedClientSubjects if there are
+	// any. The files are checked for changes every TLSReloadInterval.
+	TLSCertFile           string
+	TLSKeyFile            string
+	ClientCAFile          string
+	AllowedClientSubjects []string
+	TLSReloadInterval     time.Duration
+
+	// SigningKeys, by key id, make /credentials accept requests signed with any of them. With a
+	// ClientCAFile as well, callers can present either a signature or a client certificate.
+	SigningKeys map[string][]byte
+
+	// AllowedSources and DeniedSources are the networks, in CIDR notation, the credentials endpoints
+	// accept requests from, any if there's no allowed network. Denied networks take precedence.
+	AllowedSources []string
+	DeniedSources  []string
+
+	// CallerRateLimit and JobRateLimit limit the requests to the credentials endpoints per caller
+	// address and per job, they're unlimited with a zero Rate.
+	CallerRateLimit http_pkg.RateLimit
+	JobRateLimit    http_pkg.RateLimit
+
+	// AuditSink records every credentials request, refused ones included. It's left open on Shutdown, so the server can be
+	// started again, closing it is up to the caller.
+	AuditSink audit.Sink
+
+	// ProbeSts makes readiness call STS when no STS call succeeded recently.
+	ProbeSts bool
+
+	// ShutdownTimeout is how long Run waits for in-flight requests on SIGTERM or SIGINT.
+	ShutdownTimeout time.Duration
+
+	mutex       sync.Mutex
+	listener    net.Listener
+	httpServer  *http.Server
+	refresher   *credentials.Refresher
+	watchers    []interface{ Close() }
+	rolesFile   *role.FileRoleRepository
+	rolesStatus http_pkg.RolesStatus
+	mesos       *role.MesosRoleRepository
+	errors      chan error
+}
+
+// Start builds the repositories and handlers and starts serving in the background.
+func (s *Server) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.httpServer != nil {
+		return errors.Errorf("Server is already started")
+	}
+	if s.CacheStrategy != credentials.CachePerJob && s.CacheStrategy != credentials.CachePerRole {
+		return errors.Errorf("Unknown credentials cache strategy: %s", s.CacheStrategy)
+	}
+
+	roleRepository, err := s.createRoleRepository()
+	if err != nil {
+		return err
+	}
+
+	stsClient := s.StsClient
+	if stsClient == nil {
+		if stsClient, err = credentials.NewStsClient(s.Sts); err != nil {
+			s.stopWatchers()
+			return err
+		}
+	}
+
+	credentialsRepository := credentials.NewDefaultCredentialsRepository(stsClient, func(r *credentials.DefaultCredentialsRepository) {
+		r.MinimumLifetime = s.MinimumLifetime
+	})
+
+	registry, err := s.createRegistry(credentialsRepository)
+	if err != nil {
+		s.stopWatchers()
+		return err
+	}
+
+	if s.MesosMasterUrl != "" {
+		s.mesos = role.NewMesosRoleRepository(s.MesosMasterUrl, roleRepository, func(r *role.MesosRoleRepository) {
+			r.TTL = s.MesosStateTTL
+		})
+		s.mesos.Watch()
+		s.watchers = append(s.watchers, s.mesos)
+		roleRepository = s.mesos
+	}
+
+	agentBinding, err := s.createAgentBinding(roleRepository)
+	if err != nil {
+		s.stopWatchers()
+		return err
+	}
+
+	var tlsReloader *TLSReloader
+	if s.TLSCertFile != "" {
+		tlsReloader, err = NewTLSReloader(s.TLSCertFile, s.TLSKeyFile, s.ClientCAFile, func(r *TLSReloader) {
+			r.Interval = s.TLSReloadInterval
+		})
+		if err != nil {
+			s.stopWatchers()
+			return err
+		}
+		tlsReloader.Watch()
+		s.watchers = append(s.watchers, tlsReloader)
+	} else if s.ClientCAFile != "" {
+		s.stopWatchers()
+		return errors.Errorf("A TLS certificate is required to authenticate clients")
+	}
+
+	listener, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		s.stopWatchers()
+		return err
+	}
+	if tlsReloader != nil {
+		listener = tls.NewListener(listener, tlsReloader.Config())
+	}
+
+	handler, err := s.createHandler(roleRepository, credentialsRepository, agentBinding, registry)
+	if err != nil {
+		listener.Close()
+		s.stopWatchers()
+		return err
+	}
+
+	s.refresher = credentials.NewRefresher(credentialsRepository, func(r *credentials.Refresher) {
+		r.RefreshBefore = s.RefreshBefore
+		r.IdleTimeout = s.IdleTimeout
+	})
+	s.refresher.Start()
+
+	s.listener = listener
+	s.httpServer = &http.Server{Handler: handler}
+	s.errors = make(chan error, 1)
+
+	log.Info("Listening on ", listener.Addr())
+	go func(httpServer *http.Server, errors chan error) {
+		if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+			errors <- err
+		}
+		close(errors)
+	}(s.httpServer, s.errors)
+
+	return nil
+}
+
+// Addr returns the address the server listens on, nil if it isn't started.
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Shutdown stops accepting requests and waits for the in-flight ones until the context is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.httpServer == nil {
+		return nil
+	}
+
+	err := s.httpServer.Shutdown(ctx)
+	s.refresher.Stop()
+	s.stopWatchers()
+
+	s.httpServer = nil
+	s.listener = nil
+	return err
+}
+
+// Run starts the server and shuts it down on SIGTERM or SIGINT, waiting up to ShutdownTimeout
+// for in-flight requests. It returns when the server is stopped.
+func (s *Server) Run() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-s.errors:
+		s.Shutdown(context.Background())
+		return err
+	case sig := <-signals:
+		log.Infof("Received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+
+	return s.Shutdown(ctx)
+}
+
+func (s *Server) createRoleRepository() (role.RoleRepository, error) {
+	if s.RoleRepository != nil {
+		s.rolesStatus, _ = s.RoleRepository.(http_pkg.RolesStatus)
+		return s.RoleRepository, nil
+	}
+
+	var sources []role.ChainSource
+	for _, name := range s.RoleSources {
+		switch name {
+		case RolesFileSource:
+			if s.RolesFile == "" {
+				continue
+			}
+			repository, err := role.NewFileRoleRepository(s.RolesFile)
+			if err != nil {
+				s.stopWatchers()
+				return nil, err
+			}
+			repository.Watch(s.RolesReloadInterval)
+			s.watchers = append(s.watchers, repository)
+			s.rolesFile = repository
+			sources = append(sources, role.ChainSource{Name: "roles file " + s.RolesFile, Repository: repository})
+		case MarathonSource:
+			if s.MarathonUrl == "" {
+				continue
+			}
+			repository := role.NewMarathonRoleRepository(s.MarathonUrl, func(r *role.MarathonRoleRepository) {
+				r.Label = s.MarathonRoleLabel
+			})
+			repository.Watch()
+			s.watchers = append(s.watchers, repository)
+			sources = append(sources, role.ChainSource{Name: "Marathon", Repository: repository})
+		case MesosLabelsSource:
+			if s.MesosMasterUrl == "" {
+				s.stopWatchers()
+				return nil, errors.Errorf("A Mesos master url is required to read roles from task labels")
+			}
+			sources = append(sources, role.ChainSource{Name: "Mesos task labels", Repository: role.NewTaskLabelRoleRepository(s.MesosRoleLabel)})
+		default:
+			s.stopWatchers()
+			return nil, errors.Errorf("Unknown role source %s", name)
+		}
+
+		if s.rolesStatus == nil {
+			s.rolesStatus, _ = sources[len(sources)-1].Repository.(http_pkg.RolesStatus)
+		}
+	}
+
+	var defaultRole *role.Pattern
+	if s.DefaultRole != "" {
+		if s.DefaultRolePattern == "" {
+			s.stopWatchers()
+			return nil, errors.Errorf("A pattern is required for the default role")
+		}
+		pattern, err := role.NewGlobPattern(s.DefaultRolePattern, role.NewRole(s.DefaultRole))
+		if err != nil {
+			s.stopWatchers()
+			return nil, err
+		}
+		defaultRole = pattern
+	}
+
+	switch {
+	case len(sources) == 0 && defaultRole == nil:
+		return nil, errors.Errorf("A roles file, a Marathon url, a Mesos master url with task labels or a role repository is required")
+	case len(sources) == 1 && defaultRole == nil:
+		return sources[0].Repository, nil
+	}
+
+	return role.NewChainRoleRepository(sources, func(r *role.ChainRoleRepository) {
+		r.Default = defaultRole
+	}), nil
+}
+
+func (s *Server) stopWatchers() {
+	for _, watcher := range s.watchers {
+		watcher.Close()
+	}
+	s.watchers = nil
+	s.rolesFile = nil
+	s.rolesStatus = nil
+	s.mesos = nil
+}
+
+func (s *Server) createAgentBinding(roleRepository role.RoleRepository) (*http_pkg.AgentBinding, error) {
+	switch s.AgentBinding {
+	case "":
+		return nil, nil
+	case http_pkg.AgentIdentityAddress:
+	case http_pkg.AgentIdentityCertificate:
+		if s.ClientCAFile == "" {
+			return nil, errors.Errorf("A client CA file is required to bind credentials to agents by certificate")
+		}
+	default:
+		return nil, errors.Errorf("Unknown agent identity: %s", s.AgentBinding)
+	}
+
+	locator := s.TaskLocator
+	if locator == nil {
+		var ok bool
+		if locator, ok = roleRepository.(role.TaskLocator); !ok {
+			return nil, errors.Errorf("A Mesos master url is required to bind credentials to agents")
+		}
+	}
+
+	return http_pkg.NewAgentBinding(locator, func(b *http_pkg.AgentBinding) {
+		b.Identity = s.AgentBinding
+	}), nil
+}
+
+func (s *Server) createHandler(roleRepository role.RoleRepository, credentialsRepository *credentials.DefaultCredentialsRepository, agentBinding *http_pkg.AgentBinding, registry *prometheus.Registry) (http.Handler, error) {
+	credentialsProvider := credentials.NewDefaultCredentialsProvider(roleRepository, credentialsRepository, func(p *credentials.DefaultCredentialsProvider) {
+		p.SessionName = s.SessionName
+		p.CacheStrategy = s.CacheStrategy
+	})
+	mux := http.NewServeMux()
+
+	protect, err := s.createProtection()
+	if err != nil {
+		return nil, err
+	}
+
+	mux.Handle("/credentials/", protect("credentials", http_pkg.NewCredentialsProviderHandler(credentialsProvider, func(h *http_pkg.CredentialsProviderHandler) {
+		h.AgentBinding = agentBinding
+	}), http_pkg.GetJobIdFromRequest))
+
+	metadataRequestHandler := protect("ec2_metadata", http_pkg.NewEC2MetadataHandler(credentialsProvider, func(h *http_pkg.EC2MetadataHandler) {
+		h.AgentBinding = agentBinding
+	}), func(r *http.Request) (string, error) {
+		jobId, _, err := http_pkg.GetMetadataRequestParams(r)
+		return jobId, err
+	})
+	mux.Handle("/latest/meta-data/iam/security-credentials", metadataRequestHandler)
+	mux.Handle("/latest/meta-data/iam/security-credentials/", metadataRequestHandler)
+	mux.Handle("/jobs/", metadataRequestHandler)
+
+	tokenKey := s.ContainerTokenKey
+	if len(tokenKey) == 0 {
+		log.Warn("No container token key is set, container authorization tokens will change on restart")
+		tokenKey = make([]byte, 32)
+		if _, err := rand.Read(tokenKey); err != nil {
+			return nil, err
+		}
+	}
+	jobTokens := http_pkg.NewJobTokens(tokenKey)
+	mux.Handle("/container-credentials/", protect("container", http_pkg.NewContainerCredentialsHandler(credentialsProvider, jobTokens, func(h *http_pkg.ContainerCredentialsHandler) {
+		h.AgentBinding = agentBinding
+	}), http_pkg.GetContainerJobIdFromRequest))
+	if s.SchedulerToken != "" {
+		mux.Handle("/container-tokens/", http_pkg.NewContainerTokenHandler(jobTokens, s.SchedulerToken))
+	}
+
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	liveness := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Ok"))
+	}
+	mux.HandleFunc("/health-check/", liveness)
+	mux.HandleFunc("/live", liveness)
+
+	mux.Handle("/ready", http_pkg.NewReadinessHandler(s.rolesStatus, credentialsRepository, func(h *http_pkg.ReadinessHandler) {
+		h.Probe = s.ProbeSts
+		if s.mesos != nil {
+			h.Tasks = s.mesos
+		}
+	}))
+
+	return mux, nil
+}
+
+// createProtection returns a function putting in front of the handlers giving credentials, in
+// order: their instrumentation, their audit, the source and per caller limits, the authentication
+// of callers and the per job limit, so only authenticated requests are charged to jobs and refused
+// requests are audited too.
+func (s *Server) createProtection() (func(string, http.Handler, func(*http.Request) (string, error)) http.Handler, error) {
+	allowed, err := http_pkg.ParseCIDRs(s.AllowedSources)
+	if err != nil {
+		return nil, err
+	}
+	denied, err := http_pkg.ParseCIDRs(s.DeniedSources)
+	if err != nil {
+		return nil, err
+	}
+
+	var limiter *http_pkg.RequestLimiter
+	if len(allowed) > 0 || len(denied) > 0 || s.CallerRateLimit.Rate > 0 || s.JobRateLimit.Rate > 0 {
+		limiter = http_pkg.NewRequestLimiter(func(l *http_pkg.RequestLimiter) {
+			l.Allowed = allowed
+			l.Denied = denied
+			l.PerCaller = s.CallerRateLimit
+			l.PerJob = s.JobRateLimit
+		})
+	}
+
+	return func(name string, handler http.Handler, jobId func(*http.Request) (string, error)) http.Handler {
+		if limiter != nil {
+			handler = limiter.LimitJobs(name, handler, jobId)
+		}
+		handler = s.authenticate(handler)
+		if limiter != nil {
+			handler = limiter.LimitCallers(name, handler)
+		}
+		return http_pkg.Instrument(name, http_pkg.Audit(s.AuditSink, handler, jobId))
+	}, nil
+}
+
+// authenticate refuses the callers without an allowed client certificate, when there's a client
+// CA, or without a valid signature, when there are signing keys, on every endpoint giving
+// credentials. With both, callers can present either.
+func (s *Server) authenticate(handler http.Handler) http.Handler {
+	var certificateHandler http.Handler
+	if s.ClientCAFile != "" {
+		certificateHandler = http_pkg.NewClientCertificateHandler(handler, s.AllowedClientSubjects)
+	}
+	if len(s.SigningKeys) == 0 {
+		if certificateHandler != nil {
+			return certificateHandler
+		}
+		return handler
+	}
+	return http_pkg.NewSignedRequestHandler(handler, s.SigningKeys, func(h *http_pkg.SignedRequestHandler) {
+		h.Unsigned = certificateHandler
+	})
+}
+
+// createRegistry registers the metrics of the server in a registry of its own, so several servers
+// can run in a process. The counters of requests, STS calls and reloads are shared by the servers.
+func (s *Server) createRegistry(credentialsRepository *credentials.DefaultCredentialsRepository) (*prometheus.Registry, error) {
+	collectors := []prometheus.Collector{prometheus.NewGoCollector(), prometheus.NewProcessCollector(os.Getpid(), "")}
+	collectors = append(collectors, http_pkg.Collectors()...)
+	collectors = append(collectors, credentials.Collectors()...)
+	collectors = append(collectors, role.Collectors()...)
+	collectors = append(collectors, credentialsRepository.Collectors()...)
+	if s.rolesFile != nil {
+		collectors = append(collectors, s.rolesFile.Collectors()...)
+	}
+
+	registry := prometheus.NewRegistry()
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
@@ -0,0 +1,428 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/schibsted/smaug/audit"
+	"github.com/schibsted/smaug/client"
+	http_pkg "github.com/schibsted/smaug/http"
+	"github.com/schibsted/smaug/role"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerServesCredentials(t *testing.T) {
+	s := newTestServer(&MockSTSClient{})
+	assert.Nil(t, s.Start())
+	defer s.Shutdown(context.Background())
+
+	response, err := http.Get("http://" + s.Addr().String() + "/credentials/myjob")
+	assert.Nil(t, err)
+	defer response.Body.Close()
+
+	body, _ := ioutil.ReadAll(response.Body)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Contains(t, string(body), "Key")
+}
+
+func TestServerShutdownWaitsForInFlightRequests(t *testing.T) {
+	s := newTestServer(&MockSTSClient{delay: 200 * time.Millisecond})
+	assert.Nil(t, s.Start())
+
+	statuses := make(chan int)
+	go func() {
+		response, err := http.Get("http://" + s.Addr().String() + "/credentials/myjob")
+		if err != nil {
+			statuses <- 0
+			return
+		}
+		response.Body.Close()
+		statuses <- response.StatusCode
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.Equal(t, 200, <-statuses)
+	assert.Nil(t, s.Addr())
+}
+
+func TestServerShutdownReturnsErrorWhenTimeoutExpires(t *testing.T) {
+	s := newTestServer(&MockSTSClient{delay: 500 * time.Millisecond})
+	assert.Nil(t, s.Start())
+
+	go http.Get("http://" + s.Addr().String() + "/credentials/myjob")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+}
+
+func TestServerCanBeStartedAgainAfterShutdown(t *testing.T) {
+	s := newTestServer(&MockSTSClient{})
+	assert.Nil(t, s.Start())
+	assert.Nil(t, s.Shutdown(context.Background()))
+
+	assert.Nil(t, s.Start())
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+func TestServerKeepsAuditSinkOpenAcrossRestarts(t *testing.T) {
+	var buffer bytes.Buffer
+	sink := audit.NewWriterSink(&buffer)
+	s := newTestServer(&MockSTSClient{})
+	s.AuditSink = sink
+
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, s.Start())
+		response, err := http.Get("http://" + s.Addr().String() + "/credentials/myjob")
+		assert.Nil(t, err)
+		response.Body.Close()
+		assert.Nil(t, s.Shutdown(context.Background()))
+	}
+
+	assert.Equal(t, 2, strings.Count(buffer.String(), "\n"))
+}
+
+func TestServersInTheSameProcessServeTheirOwnMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smaug-server")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var servers []*Server
+	for i, roles := range []string{"myjob = arn:aws:iam::111111111:myrole/role\n", "myjob = arn:aws:iam::111111111:myrole/role\nother = arn:aws:iam::111111111:myrole/other\n"} {
+		rolesFile := filepath.Join(dir, fmt.Sprintf("roles%d.ini", i))
+		assert.Nil(t, ioutil.WriteFile(rolesFile, []byte("[roles]\n"+roles), 0644))
+		s := NewServer(func(s *Server) {
+			s.Address = "127.0.0.1:0"
+			s.RolesFile = rolesFile
+			s.StsClient = &MockSTSClient{}
+		})
+		assert.Nil(t, s.Start())
+		defer s.Shutdown(context.Background())
+		servers = append(servers, s)
+	}
+
+	for i, s := range servers {
+		response, err := http.Get("http://" + s.Addr().String() + "/metrics")
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Contains(t, string(body), fmt.Sprintf("smaug_roles_mapped_jobs %d", i+1))
+		assert.Contains(t, string(body), "smaug_http_requests_total")
+	}
+}
+
+func TestServerStartReturnsErrorWhenAddressIsInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	s := newTestServer(&MockSTSClient{})
+	s.Address = listener.Addr().String()
+
+	assert.Error(t, s.Start())
+	assert.Nil(t, s.Addr())
+}
+
+func TestServerStartReturnsErrorWhenRolesFileIsMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smaug-server")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewServer(func(s *Server) {
+		s.Address = "127.0.0.1:0"
+		s.RolesFile = filepath.Join(dir, "missing.ini")
+		s.StsClient = &MockSTSClient{}
+	})
+
+	assert.Error(t, s.Start())
+}
+
+func TestServerChainsRoleSourcesWithDefaultRole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smaug-server")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	rolesFile := filepath.Join(dir, "roles.ini")
+	assert.Nil(t, ioutil.WriteFile(rolesFile, []byte("[roles]\nmyjob = arn:aws:iam::111111111:myrole/role\n"), 0644))
+
+	s := NewServer(func(s *Server) {
+		s.Address = "127.0.0.1:0"
+		s.RolesFile = rolesFile
+		s.DefaultRole = "arn:aws:iam::111111111:myrole/default"
+		s.DefaultRolePattern = "sandbox_*"
+		s.StsClient = &MockSTSClient{}
+	})
+	assert.Nil(t, s.Start())
+	defer s.Shutdown(context.Background())
+
+	for jobId, expectedStatus := range map[string]int{"myjob": 200, "sandbox_app.1234": 200, "team_app.1234": 404} {
+		response, err := http.Get("http://" + s.Addr().String() + "/credentials/" + jobId)
+		assert.Nil(t, err)
+		response.Body.Close()
+		assert.Equal(t, expectedStatus, response.StatusCode, jobId)
+	}
+}
+
+func TestServerStartReturnsErrorForUnknownRoleSource(t *testing.T) {
+	s := NewServer(func(s *Server) {
+		s.Address = "127.0.0.1:0"
+		s.RoleSources = []string{"consul"}
+		s.StsClient = &MockSTSClient{}
+	})
+
+	assert.Error(t, s.Start())
+}
+
+func TestServerMapsMesosTasksByLabelAndReportsTheMaster(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"frameworks": [{"id": "framework-1", "name": "marathon", "tasks": [
+			{"id": "team_app.1234", "state": "TASK_RUNNING", "labels": [{"key": "SMAUG_ROLE", "value": "arn:aws:iam::111111111:myrole/role"}]},
+			{"id": "team_web.1234", "state": "TASK_RUNNING"}]}]}`)
+	}))
+	defer master.Close()
+
+	s := NewServer(func(s *Server) {
+		s.Address = "127.0.0.1:0"
+		s.MesosMasterUrl = master.URL
+		s.RoleSources = []string{MesosLabelsSource}
+		s.StsClient = &MockSTSClient{}
+	})
+	assert.Nil(t, s.Start())
+	defer s.Shutdown(context.Background())
+
+	var readiness http_pkg.Readiness
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		response, err := http.Get("http://" + s.Addr().String() + "/ready")
+		assert.Nil(t, err)
+		json.NewDecoder(response.Body).Decode(&readiness)
+		response.Body.Close()
+		if readiness.Ready {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.NotNil(t, readiness.Tasks) {
+		assert.True(t, readiness.Tasks.Ok)
+		assert.Equal(t, 2, readiness.Tasks.Jobs)
+	}
+
+	for jobId, expectedStatus := range map[string]int{"team_app.1234": 200, "team_web.1234": 404} {
+		response, err := http.Get("http://" + s.Addr().String() + "/credentials/" + jobId)
+		assert.Nil(t, err)
+		response.Body.Close()
+		assert.Equal(t, expectedStatus, response.StatusCode, jobId)
+	}
+}
+
+func TestServerStartReturnsErrorForMesosLabelsWithoutMaster(t *testing.T) {
+	s := NewServer(func(s *Server) {
+		s.Address = "127.0.0.1:0"
+		s.RoleSources = []string{MesosLabelsSource}
+		s.StsClient = &MockSTSClient{}
+	})
+
+	assert.Error(t, s.Start())
+}
+
+func TestServerBindsCredentialsToAgents(t *testing.T) {
+	s := newTestServer(&MockSTSClient{})
+	s.AgentBinding = "address"
+	s.TaskLocator = testTaskLocator{"myjob": "127.0.0.1", "otherjob": "127.0.0.2"}
+	assert.Nil(t, s.Start())
+	defer s.Shutdown(context.Background())
+
+	for jobId, expectedStatus := range map[string]int{"myjob": 200, "otherjob": 403} {
+		response, err := http.Get("http://" + s.Addr().String() + "/credentials/" + jobId)
+		assert.Nil(t, err)
+		response.Body.Close()
+		assert.Equal(t, expectedStatus, response.StatusCode, jobId)
+	}
+}
+
+func TestServerStartReturnsErrorForInvalidAgentBinding(t *testing.T) {
+	s := newTestServer(&MockSTSClient{})
+	s.AgentBinding = "address"
+	assert.Error(t, s.Start())
+
+	s.AgentBinding = "hostname"
+	s.TaskLocator = testTaskLocator{}
+	assert.Error(t, s.Start())
+
+	s.AgentBinding = "certificate"
+	assert.Error(t, s.Start())
+}
+
+func TestServerAcceptsSignedRequests(t *testing.T) {
+	s := newTestServer(&MockSTSClient{})
+	s.SigningKeys = map[string][]byte{"key": []byte("secret")}
+	assert.Nil(t, s.Start())
+	defer s.Shutdown(context.Background())
+
+	for _, path := range []string{"/credentials/myjob", "/jobs/myjob/latest/meta-data/iam/security-credentials/"} {
+		url := "http://" + s.Addr().String() + path
+		signed, _ := http.NewRequest("GET", url, nil)
+		assert.Nil(t, client.NewSigner("key", []byte("secret")).Sign(signed))
+		unsigned, _ := http.NewRequest("GET", url, nil)
+
+		for expectedStatus, req := range map[int]*http.Request{200: signed, 401: unsigned} {
+			response, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err)
+			response.Body.Close()
+			assert.Equal(t, expectedStatus, response.StatusCode, path)
+		}
+	}
+}
+
+func TestServerLimitsRequests(t *testing.T) {
+	s := newTestServer(&MockSTSClient{})
+	s.DeniedSources = []string{"10.0.0.0/8"}
+	s.JobRateLimit = http_pkg.RateLimit{Rate: 0.1, Burst: 1}
+	assert.Nil(t, s.Start())
+	defer s.Shutdown(context.Background())
+
+	url := "http://" + s.Addr().String() + "/credentials/myjob"
+	for _, expectedStatus := range []int{200, 429} {
+		response, err := http.Get(url)
+		assert.Nil(t, err)
+		response.Body.Close()
+		assert.Equal(t, expectedStatus, response.StatusCode)
+	}
+}
+
+func TestServerOnlyChargesJobsWithAuthenticatedRequests(t *testing.T) {
+	s := newTestServer(&MockSTSClient{})
+	s.SigningKeys = map[string][]byte{"key": []byte("secret")}
+	s.JobRateLimit = http_pkg.RateLimit{Rate: 0.1, Burst: 1}
+	assert.Nil(t, s.Start())
+	defer s.Shutdown(context.Background())
+
+	url := "http://" + s.Addr().String() + "/credentials/myjob"
+	for i := 0; i < 3; i++ {
+		response, err := http.Get(url)
+		assert.Nil(t, err)
+		response.Body.Close()
+		assert.Equal(t, 401, response.StatusCode)
+	}
+
+	signer := client.NewSigner("key", []byte("secret"))
+	for _, expectedStatus := range []int{200, 429} {
+		signed, _ := http.NewRequest("GET", url, nil)
+		assert.Nil(t, signer.Sign(signed))
+		response, err := http.DefaultClient.Do(signed)
+		assert.Nil(t, err)
+		response.Body.Close()
+		assert.Equal(t, expectedStatus, response.StatusCode)
+	}
+}
+
+func TestServerAuditsRefusedRequests(t *testing.T) {
+	sink := &recordingSink{}
+	s := newTestServer(&MockSTSClient{})
+	s.AuditSink = sink
+	s.SigningKeys = map[string][]byte{"key": []byte("secret")}
+	s.JobRateLimit = http_pkg.RateLimit{Rate: 0.1, Burst: 1}
+	assert.Nil(t, s.Start())
+	defer s.Shutdown(context.Background())
+
+	url := "http://" + s.Addr().String() + "/credentials/myjob"
+	unsigned, _ := http.NewRequest("GET", url, nil)
+	unknownKey, _ := http.NewRequest("GET", url, nil)
+	assert.Nil(t, client.NewSigner("other", []byte("secret")).Sign(unknownKey))
+	requests := []*http.Request{unsigned, unknownKey}
+	for i := 0; i < 2; i++ {
+		signed, _ := http.NewRequest("GET", url, nil)
+		assert.Nil(t, client.NewSigner("key", []byte("secret")).Sign(signed))
+		requests = append(requests, signed)
+	}
+
+	for i, expectedStatus := range []int{401, 403, 200, 429} {
+		response, err := http.DefaultClient.Do(requests[i])
+		assert.Nil(t, err)
+		response.Body.Close()
+		assert.Equal(t, expectedStatus, response.StatusCode)
+	}
+
+	records := sink.Records()
+	if assert.Len(t, records, 4) {
+		for i, outcome := range []string{"Unauthorized", "AccessDenied", "Success", "RateLimited"} {
+			assert.Equal(t, "myjob", records[i].JobId)
+			assert.Equal(t, outcome, records[i].Outcome)
+			assert.NotEmpty(t, records[i].RequestId)
+		}
+	}
+}
+
+func TestServerStartReturnsErrorForInvalidSources(t *testing.T) {
+	s := newTestServer(&MockSTSClient{})
+	s.AllowedSources = []string{"10.0.0.0/33"}
+
+	assert.Error(t, s.Start())
+}
+
+type testTaskLocator map[string]string
+
+func (l testTaskLocator) FindTask(taskId string) (*role.Task, error) {
+	return &role.Task{Id: taskId, State: "TASK_RUNNING", AgentHostname: l[taskId]}, nil
+}
+
+type recordingSink struct {
+	lock    sync.Mutex
+	records []audit.Record
+}
+
+func (s *recordingSink) Record(record audit.Record) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.records = append(s.records, record)
+}
+
+func (s *recordingSink) Records() []audit.Record {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]audit.Record(nil), s.records...)
+}
+
+func newTestServer(stsClient stsiface.STSAPI) *Server {
+	roleRepository := role.NewInMemoryRoleRepository()
+	roleRepository.AddRole("myjob", "arn:aws:iam::111111111:myrole/role")
+
+	return NewServer(func(s *Server) {
+		s.Address = "127.0.0.1:0"
+		s.RoleRepository = roleRepository
+		s.StsClient = stsClient
+		s.ContainerTokenKey = []byte("key")
+	})
+}
+
+type MockSTSClient struct {
+	stsiface.STSAPI
+	delay time.Duration
+}
+
+func (m *MockSTSClient) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	time.Sleep(m.delay)
+	return &sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("Key"),
+			SecretAccessKey: aws.String("Secret"),
+			SessionToken:    aws.String("Token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/go-errors/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTLSReloadInterval is how often the certificate, key and client CA files are checked for changes.
+const DefaultTLSReloadInterval = 1 * time.Minute
+
+// TLS Reloader
+//
+// TLSReloader serves the certificate and the client CAs read from files, and reads them again when
+// they change, so they can be renewed without a restart. Clients must present a certificate signed by
+// one of the CAs if there's a client CA file, and the files that fail to load are ignored until they
+// change again.
+func NewTLSReloader(certFile string, keyFile string, clientCAFile string, options ...func(*TLSReloader)) (*TLSReloader, error) {
+	reloader := &TLSReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		Interval:     DefaultTLSReloadInterval,
+	}
+
+	for _, option := range options {
+		option(reloader)
+	}
+
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+type TLSReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	// Interval between checks of the files, zero to never reload them.
+	Interval time.Duration
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	versions    []fileVersion
+	stop        chan struct{}
+}
+
+// Config returns a TLS config taking the certificate and client CAs from the reloader.
+func (r *TLSReloader) Config() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+	}
+	if r.clientCAFile != "" {
+		config.GetConfigForClient = r.getConfigForClient
+	}
+	return config
+}
+
+// Reload reads the files again, keeping the previous certificate and CAs if they can't be read.
+func (r *TLSReloader) Reload() error {
+	versions := r.fileVersions()
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Errorf("Could not load TLS certificate %s: %s", r.certFile, err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return errors.Errorf("Could not load client CAs: %s", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.Errorf("No certificate found in client CA file %s", r.clientCAFile)
+		}
+	}
+
+	r.mutex.Lock()
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.versions = versions
+	r.mutex.Unlock()
+
+	return nil
+}
+
+// Watch reloads the files when they change until Close is called.
+func (r *TLSReloader) Watch() {
+	r.mutex.Lock()
+	if r.stop != nil || r.Interval <= 0 {
+		r.mutex.Unlock()
+		return
+	}
+	r.stop = make(chan struct{})
+	stop := r.stop
+	r.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if !r.changed() {
+					continue
+				}
+				if err := r.Reload(); err != nil {
+					log.Error("Could not reload TLS files, keeping the previous ones: ", err)
+					r.mutex.Lock()
+					r.versions = r.fileVersions()
+					r.mutex.Unlock()
+					continue
+				}
+				log.Info("Reloaded TLS certificate ", r.certFile)
+			}
+		}
+	}()
+}
+
+// Close stops watching the files.
+func (r *TLSReloader) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+func (r *TLSReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.certificate, nil
+}
+
+// getConfigForClient makes every handshake use the current client CAs.
+func (r *TLSReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+		ClientAuth:     tls.VerifyClientCertIfGiven,
+		ClientCAs:      r.clientCAs,
+	}, nil
+}
+
+func (r *TLSReloader) changed() bool {
+	versions := r.fileVersions()
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for i := range versions {
+		if versions[i] != r.versions[i] {
+			return true
+		}
+	}
+	return false
+}
+
+type fileVersion struct {
+	modified time.Time
+	size     int64
+}
+
+func (r *TLSReloader) fileVersions() []fileVersion {
+	var versions []fileVersion
+	for _, path := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		var version fileVersion
+		if info, err := os.Stat(path); err == nil {
+			version = fileVersion{info.ModTime(), info.Size()}
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerAuthenticatesClientsOfCredentialsEndpointsWithCertificates(t *testing.T) {
+	ca := newTestCertificate(t, "ca", 1, nil)
+	dir := writeTLSFiles(t, "", newTestCertificate(t, "127.0.0.1", 2, ca), ca)
+	defer os.RemoveAll(dir)
+
+	s := newTestServer(&MockSTSClient{})
+	s.TLSCertFile = filepath.Join(dir, "cert.pem")
+	s.TLSKeyFile = filepath.Join(dir, "key.pem")
+	s.ClientCAFile = filepath.Join(dir, "ca.pem")
+	s.AllowedClientSubjects = []string{"agent"}
+	assert.Nil(t, s.Start())
+	defer s.Shutdown(context.Background())
+
+	url := "https://" + s.Addr().String()
+	agent := newTLSClient(ca, newTestCertificate(t, "agent", 3, ca))
+	intruder := newTLSClient(ca, newTestCertificate(t, "intruder", 4, ca))
+	untrusted := newTLSClient(ca, newTestCertificate(t, "agent", 5, newTestCertificate(t, "other-ca", 6, nil)))
+	anonymous := newTLSClient(ca, nil)
+
+	assertStatus(t, 200, agent, url+"/credentials/myjob")
+	assertStatus(t, 403, intruder, url+"/credentials/myjob")
+	assertStatus(t, 401, anonymous, url+"/credentials/myjob")
+	assertStatus(t, 200, agent, url+"/jobs/myjob/latest/meta-data/iam/security-credentials/")
+	assertStatus(t, 403, intruder, url+"/jobs/myjob/latest/meta-data/iam/security-credentials/")
+	assertStatus(t, 401, anonymous, url+"/jobs/myjob/latest/meta-data/iam/security-credentials/")
+	assertStatus(t, 401, anonymous, url+"/container-credentials/myjob")
+	assertStatus(t, 200, anonymous, url+"/live")
+
+	_, err := untrusted.Get(url + "/credentials/myjob")
+	assert.Error(t, err)
+}
+
+func TestServerStartReturnsErrorForClientCAWithoutCertificate(t *testing.T) {
+	s := newTestServer(&MockSTSClient{})
+	s.ClientCAFile = "ca.pem"
+
+	assert.Error(t, s.Start())
+}
+
+func TestTLSReloaderReloadsChangedFiles(t *testing.T) {
+	ca := newTestCertificate(t, "ca", 1, nil)
+	dir := writeTLSFiles(t, "", newTestCertificate(t, "127.0.0.1", 2, ca), ca)
+	defer os.RemoveAll(dir)
+
+	reloader, err := NewTLSReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem"), func(r *TLSReloader) {
+		r.Interval = 10 * time.Millisecond
+	})
+	assert.Nil(t, err)
+	reloader.Watch()
+	defer reloader.Close()
+
+	renewedCA := newTestCertificate(t, "renewed-ca", 3, nil)
+	writeTLSFiles(t, dir, newTestCertificate(t, "127.0.0.1", 4, renewedCA), renewedCA)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		certificate, _ := reloader.getCertificate(nil)
+		config, _ := reloader.getConfigForClient(nil)
+		leaf, _ := x509.ParseCertificate(certificate.Certificate[0])
+		if leaf.SerialNumber.Int64() == 4 && len(config.ClientCAs.Subjects()) == 1 && string(config.ClientCAs.Subjects()[0]) == string(renewedCA.cert.RawSubject) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("TLS files were not reloaded")
+}
+
+func TestTLSReloaderKeepsPreviousFilesIfNewOnesAreInvalid(t *testing.T) {
+	ca := newTestCertificate(t, "ca", 1, nil)
+	dir := writeTLSFiles(t, "", newTestCertificate(t, "127.0.0.1", 2, ca), ca)
+	defer os.RemoveAll(dir)
+
+	reloader, err := NewTLSReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), "")
+	assert.Nil(t, err)
+
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte("invalid"), 0600)
+	assert.Error(t, reloader.Reload())
+
+	certificate, _ := reloader.getCertificate(nil)
+	leaf, _ := x509.ParseCertificate(certificate.Certificate[0])
+	assert.Equal(t, int64(2), leaf.SerialNumber.Int64())
+}
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCertificate generates a certificate signed by parent, or a CA if parent is nil.
+func newTestCertificate(t *testing.T, commonName string, serial int64, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(commonName); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{cert, key}
+}
+
+func (c *testCertificate) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCertificate) keyPEM() []byte {
+	der, _ := x509.MarshalECPrivateKey(c.key)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	certificate, _ := tls.X509KeyPair(c.certPEM(), c.keyPEM())
+	return certificate
+}
+
+// writeTLSFiles writes cert.pem, key.pem and ca.pem to dir, or to a new directory if dir is empty.
+func writeTLSFiles(t *testing.T, dir string, server *testCertificate, ca *testCertificate) string {
+	if dir == "" {
+		var err error
+		if dir, err = ioutil.TempDir("", "smaug-tls"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, content := range map[string][]byte{"cert.pem": server.certPEM(), "key.pem": server.keyPEM(), "ca.pem": ca.certPEM()} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func newTLSClient(ca *testCertificate, client *testCertificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	config := &tls.Config{RootCAs: roots}
+	if client != nil {
+		// Always present the certificate, even if the server doesn't ask for its CA
+		certificate := client.tlsCertificate()
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &certificate, nil
+		}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}, Timeout: 5 * time.Second}
+}
+
+func assertStatus(t *testing.T, expected int, client *http.Client, url string) {
+	response, err := client.Get(url)
+	if assert.Nil(t, err) {
+		response.Body.Close()
+		assert.Equal(t, expected, response.StatusCode, url)
+	}
+}